@@ -93,6 +93,10 @@ func getProcessedLog(w http.ResponseWriter, r *http.Request) {
 	getLog(w, r, "processed.log")
 }
 
+func getJanitorLog(w http.ResponseWriter, r *http.Request) {
+	getLog(w, r, "janitor.log")
+}
+
 func requestStop(w http.ResponseWriter, r *http.Request) {
 	_ = glg.Info("endpoint hit: shut down service")
 	select {
@@ -145,10 +149,16 @@ func startHttpServer(port int) *http.Server {
 	router.HandleFunc("/fields/{id}/{el}/", deleteField).Methods("DELETE")
 
 	router.HandleFunc("/jobs/jobsforclient/", getJobsForClient).Methods("GET")
+	router.HandleFunc("/jobs/current/cancel", cancelCurrentJob).Methods("PUT")
 	router.HandleFunc("/jobs/", getAllJobs).Methods("GET")
 	router.HandleFunc("/jobs/", insertJob).Methods("POST")
 	router.HandleFunc("/jobs/", updateJob).Methods("PUT")
 	router.HandleFunc("/jobs/{id}/", deleteJob).Methods("DELETE")
+	router.HandleFunc("/jobs/{id}/bump/", bumpJob).Methods("PUT")
+	router.HandleFunc("/jobs/{id}/sink/", sinkJob).Methods("PUT")
+
+	router.HandleFunc("/history/", getJobHistory).Methods("GET")
+	router.HandleFunc("/history/{id}/", getJobHistoryEntry).Methods("GET")
 
 	router.HandleFunc("/clients/", getAllClients).Methods("GET")
 	router.HandleFunc("/clients/", insertClient).Methods("POST")
@@ -163,6 +173,7 @@ func startHttpServer(port int) *http.Server {
 	router.HandleFunc("/logs/err", getErrorLog).Methods("GET")
 	router.HandleFunc("/logs/skipped", getSkippedLog).Methods("GET")
 	router.HandleFunc("/logs/processed", getProcessedLog).Methods("GET")
+	router.HandleFunc("/logs/janitor", getJanitorLog).Methods("GET")
 
 	router.HandleFunc("/ws/status", serveWsStatus)
 
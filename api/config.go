@@ -7,6 +7,7 @@ import (
 
 	"github.com/Spiritreader/avior-go/cache"
 	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/library"
 	"github.com/Spiritreader/avior-go/redis"
 	"github.com/kpango/glg"
 )
@@ -42,6 +43,7 @@ func modifyConfig(w http.ResponseWriter, r *http.Request) {
 	cfg.Update(*configNew)
 	_ = config.Save()
 	redis.AutoManage(prevRedisCfg)
+	library.AutoManage()
 	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", " ")
 	_ = encoder.Encode(config.Instance())
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/kpango/glg"
+)
+
+func getJobHistory(w http.ResponseWriter, r *http.Request) {
+	_ = glg.Log("endpoint hit: job history")
+	query := r.URL.Query()
+	limit, _ := strconv.ParseInt(query.Get("limit"), 10, 64)
+	history, err := aviorDb.GetJobHistory(query.Get("path"), query.Get("name"), limit)
+	if err != nil {
+		_ = glg.Errorf("error getting job history, %s", err)
+		encoder := json.NewEncoder(w)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = encoder.Encode(err.Error())
+		return
+	}
+	encoder := json.NewEncoder(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.SetIndent("", " ")
+	_ = encoder.Encode(history)
+}
+
+func getJobHistoryEntry(w http.ResponseWriter, r *http.Request) {
+	_ = glg.Log("endpoint hit: job history entry")
+	keys := mux.Vars(r)
+	entry, err := aviorDb.GetJobHistoryEntry(keys["id"])
+	if err != nil {
+		_ = glg.Errorf("error getting job history entry %s, %s", keys["id"], err)
+		encoder := json.NewEncoder(w)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = encoder.Encode(err.Error())
+		return
+	}
+	if entry == nil {
+		encoder := json.NewEncoder(w)
+		w.WriteHeader(http.StatusNotFound)
+		_ = encoder.Encode("history entry not found")
+		return
+	}
+	encoder := json.NewEncoder(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.SetIndent("", " ")
+	_ = encoder.Encode(entry)
+}
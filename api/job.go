@@ -2,14 +2,17 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 
 	"github.com/Spiritreader/avior-go/consts"
 	"github.com/Spiritreader/avior-go/structs"
+	"github.com/Spiritreader/avior-go/worker"
 	"github.com/gorilla/mux"
 	"github.com/kpango/glg"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func getAllJobs(w http.ResponseWriter, r *http.Request) {
@@ -90,6 +93,66 @@ func deleteJob(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+func bumpJob(w http.ResponseWriter, r *http.Request) {
+	_ = glg.Log("endpoint hit: bump job")
+	reorderJob(w, r, true)
+}
+
+func sinkJob(w http.ResponseWriter, r *http.Request) {
+	_ = glg.Log("endpoint hit: sink job")
+	reorderJob(w, r, false)
+}
+
+func reorderJob(w http.ResponseWriter, r *http.Request, toFront bool) {
+	keys := mux.Vars(r)
+	var job *structs.Job
+	var err error
+	if toFront {
+		job, err = aviorDb.BumpJob(keys["id"])
+	} else {
+		job, err = aviorDb.SinkJob(keys["id"])
+	}
+	if err != nil {
+		_ = glg.Errorf("could not reorder job %s: %s", keys["id"], err)
+		if err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		encoder := json.NewEncoder(w)
+		_ = encoder.Encode(err.Error())
+		return
+	}
+	encoder := json.NewEncoder(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.SetIndent("", " ")
+	_ = encoder.Encode(job)
+}
+
+func cancelCurrentJob(w http.ResponseWriter, r *http.Request) {
+	_ = glg.Info("endpoint hit: cancel current job")
+	action := r.URL.Query().Get("action")
+	if len(action) == 0 {
+		action = consts.CANCEL_ACTION_REQUEUE
+	}
+	err := worker.CancelCurrentJob(action)
+	if err != nil {
+		_ = glg.Errorf("could not cancel current job: %s", err)
+		if errors.Is(err, worker.ErrNoJob) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		encoder := json.NewEncoder(w)
+		_ = encoder.Encode(err.Error())
+		return
+	}
+	encoder := json.NewEncoder(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.SetIndent("", " ")
+	_ = encoder.Encode("cancel signal sent, action: " + action)
+}
+
 func modifyJob(w http.ResponseWriter, r *http.Request, mode string) error {
 	reqBody, _ := io.ReadAll(r.Body)
 	var job structs.Job
@@ -102,9 +165,12 @@ func modifyJob(w http.ResponseWriter, r *http.Request, mode string) error {
 		return err
 	}
 
-	// check if unmarshalling actually works
+	// check if unmarshalling actually works, jobs without a client are placed in the shared pool
 	idstring, _ := job.AssignedClient.ID.(string)
-	poid, err := primitive.ObjectIDFromHex(idstring)
+	poid := primitive.NilObjectID
+	if len(idstring) > 0 {
+		poid, err = primitive.ObjectIDFromHex(idstring)
+	}
 	if err != nil {
 		_ = glg.Errorf("could not %s job %s: %s", mode, job.Name, "failed deriving client poid");
 		w.WriteHeader(http.StatusInternalServerError)
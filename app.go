@@ -9,10 +9,15 @@ import (
 	"time"
 
 	"github.com/Spiritreader/avior-go/api"
+	"github.com/Spiritreader/avior-go/comparator"
 	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/consts"
 	"github.com/Spiritreader/avior-go/db"
 	"github.com/Spiritreader/avior-go/globalstate"
+	"github.com/Spiritreader/avior-go/janitor"
+	"github.com/Spiritreader/avior-go/library"
 	"github.com/Spiritreader/avior-go/redis"
+	"github.com/Spiritreader/avior-go/shares"
 	"github.com/Spiritreader/avior-go/tools"
 	"github.com/Spiritreader/avior-go/worker"
 	"github.com/kpango/glg"
@@ -154,6 +159,18 @@ func runService(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFu
 		_ = glg.Info("signed in %s", client.Name)
 	}
 
+	// learn output sizes from finished encodes
+	comparator.SetSizeModel(comparator.NewSizeModel(dataStore))
+
+	// finish or roll back a job that was interrupted by a crash
+	worker.Recover(dataStore, client)
+
+	// pause while media shares are unreachable
+	go shares.Run(ctx)
+
+	// delete old files from the obsolete, done and exists directories
+	go janitor.Run(ctx)
+
 MainLoop:
 	for {
 		// check if client is allowed to run
@@ -177,8 +194,13 @@ MainLoop:
 			if err != nil {
 				_ = glg.Errorf("failed getting next job: %s", err)
 			} else if job != nil {
-				_, err = dataStore.DeleteJob(job.ID.Hex())
+				releaseLease := dataStore.KeepJobLease(job)
 				worker.ProcessJob(dataStore, client, job, resumeChan)
+				releaseLease()
+				// requeued jobs stay in the queue
+				if job.Status != consts.JOB_STATUS_QUEUED {
+					_, err = dataStore.DeleteClaimedJob(job)
+				}
 				if err != nil {
 					_ = glg.Failf("couldn't delete job, program has to pause to prevent it from retaking the job")
 					state.Paused = true
@@ -219,6 +241,7 @@ MainLoop:
 	apiChan <- "stop"
 	redis := redis.Get()
 	redis.Handle.Close()
+	library.Close()
 	wg.Done()
 	cancel()
 }
@@ -242,4 +265,5 @@ func refreshConfig() {
 		_ = glg.Infof("could not refresh shared config from db: %s", err)
 	}
 	redis.AutoManage(prevRedisCfg)
+	library.AutoManage()
 }
@@ -1,6 +1,8 @@
 package cache
 
 import (
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
@@ -17,6 +19,7 @@ type Library struct {
 	Data       []string
 	LastUpdate time.Time
 	Valid      bool `json:"-"`
+	mutex      sync.Mutex
 }
 
 // Instance retrieves the current configuration file instance
@@ -28,3 +31,61 @@ func Instance() *Data {
 	})
 	return instance
 }
+
+// Paths returns a copy of the cached paths
+func (l *Library) Paths() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.Data...)
+}
+
+// Add caches a path if it isn't cached yet
+func (l *Library) Add(path string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, cached := range l.Data {
+		if cached == path {
+			return
+		}
+	}
+	l.Data = append(l.Data, path)
+}
+
+// Remove removes a path from the cache
+func (l *Library) Remove(path string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for idx, cached := range l.Data {
+		if cached == path {
+			l.Data = append(l.Data[:idx], l.Data[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Move replaces from with to, to is only cached if it is part of the library
+func (l *Library) Move(from string, to string) {
+	l.Remove(from)
+	if InLibrary(to) {
+		l.Add(to)
+	}
+}
+
+// Replace replaces all cached paths with a complete library and marks the cache as valid
+func (l *Library) Replace(paths []string, lastUpdate time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.Data = paths
+	l.LastUpdate = lastUpdate
+	l.Valid = true
+}
+
+// InLibrary returns false for paths in hidden directories like .obsolete, they are skipped by library scans
+func InLibrary(path string) bool {
+	for _, element := range strings.Split(filepath.Dir(path), string(filepath.Separator)) {
+		if strings.HasPrefix(element, ".") && element != "." && element != ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLibraryMove(t *testing.T) {
+	library := &Library{}
+	movie := filepath.Join("media", "movies", "Der Pate.mkv")
+	obsolete := filepath.Join("media", ".obsolete", "Der Pate.mkv")
+	library.Add(movie)
+	library.Add(movie)
+	if paths := library.Paths(); len(paths) != 1 {
+		t.Fatalf("expected paths to be added once, got %v", paths)
+	}
+	library.Move(movie, obsolete)
+	if paths := library.Paths(); len(paths) != 0 {
+		t.Errorf("expected moves to hidden directories to remove the path, got %v", paths)
+	}
+	library.Move(obsolete, movie)
+	if paths := library.Paths(); len(paths) != 1 || paths[0] != movie {
+		t.Errorf("expected the path to be restored, got %v", paths)
+	}
+}
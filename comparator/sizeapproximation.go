@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Spiritreader/avior-go/config"
@@ -19,6 +21,23 @@ import (
 
 var state *globalstate.Data = globalstate.Instance()
 
+// estimates caches the sampled output rate of the new file, so its slices are encoded once per job
+// no matter how many duplicates it is compared with
+var estimates struct {
+	sync.Mutex
+	key string
+	// rate is the estimated output size in bytes per minute
+	rate float64
+}
+
+// ResetEstimates drops the cached output rate of the previous job
+func ResetEstimates() {
+	estimates.Lock()
+	defer estimates.Unlock()
+	estimates.key = ""
+	estimates.rate = 0
+}
+
 type SizeApproxModule struct {
 	moduleConfig *config.ModuleConfig
 	settings     config.SizeApproxModuleSettings
@@ -47,23 +66,33 @@ func (s *SizeApproxModule) Run(files ...media.File) (string, string, string) {
 	s.new = files[0]
 	s.duplicate = files[1]
 	startTime := time.Now()
-	estimatedSize, duplicateSize, difference, err := s.estimate()
+	var estimatedSize, duplicateSize int64
+	var difference int
+	var err error
+	method := "estimated"
+	if predictedSize, ok := s.predict(); ok {
+		method = "predicted"
+		estimatedSize, duplicateSize, difference, err = s.compare(predictedSize)
+	} else {
+		estimatedSize, duplicateSize, difference, err = s.estimate()
+	}
 	state.Encoder.Slice = 0
 	state.Encoder.OfSlices = 0
+	state.Encoder.Slices = nil
 	if err != nil {
 		return s.Name(), NOCH, fmt.Sprintf("module error: %s", err)
 	}
 	since := time.Since(startTime)
 	_ = glg.Infof("approx module: estimation took %s", since)
 	if difference > s.settings.Difference {
-		return s.Name(), REPL, fmt.Sprintf("new/old: ratio: %s/%s: %d",
-			tools.ByteCountSI(estimatedSize), tools.ByteCountSI(duplicateSize), difference)
+		return s.Name(), REPL, fmt.Sprintf("new/old: ratio: %s/%s: %d (%s)",
+			tools.ByteCountSI(estimatedSize), tools.ByteCountSI(duplicateSize), difference, method)
 	} else if difference >= 0 {
-		return s.Name(), NOCH, fmt.Sprintf("new/old: ratio: %s/%s: %d",
-			tools.ByteCountSI(estimatedSize), tools.ByteCountSI(duplicateSize), difference)
+		return s.Name(), NOCH, fmt.Sprintf("new/old: ratio: %s/%s: %d (%s)",
+			tools.ByteCountSI(estimatedSize), tools.ByteCountSI(duplicateSize), difference, method)
 	} else if difference < 0 {
-		return s.Name(), DISC, fmt.Sprintf("new/old: ratio: %s/%s: %d",
-			tools.ByteCountSI(estimatedSize), tools.ByteCountSI(duplicateSize), difference)
+		return s.Name(), DISC, fmt.Sprintf("new/old: ratio: %s/%s: %d (%s)",
+			tools.ByteCountSI(estimatedSize), tools.ByteCountSI(duplicateSize), difference, method)
 	}
 	return s.Name(), DISC, "no criteria matched for replacement"
 }
@@ -85,53 +114,111 @@ func (s *SizeApproxModule) estimate() (int64, int64, int, error) {
 		_ = glg.Error("invalid module settings, must be greater than 0")
 		return -1, -1, -1, errors.New("invalid settings")
 	}
+	estimates.Lock()
+	defer estimates.Unlock()
+	key := fmt.Sprintf("%s %+v", s.new.Path, s.settings)
+	if estimates.key != key {
+		rate, err := s.sample()
+		if err != nil {
+			return -1, -1, -1, err
+		}
+		estimates.key, estimates.rate = key, rate
+	} else {
+		_ = glg.Infof("approx module: reusing the estimate of %s", s.new.Path)
+	}
+	return s.compare(int64(math.Ceil(estimates.rate * float64(s.duplicate.RecordedLength))))
+}
+
+// sample encodes slices of the new file and returns its estimated output size in bytes per minute
+func (s *SizeApproxModule) sample() (float64, error) {
 	encSlices := s.settings.SampleCount
+	state.Encoder.Slice = 0
 	state.Encoder.OfSlices = encSlices
 	// Time units is how many seconds slices are apart from each other
 	// encSlices + 1 because there needs to be room at the end of the file and the entry point mustn't be EOF for 1 slice.
-	timeUnits := s.duplicate.RecordedLength * 60 / (encSlices + 1)
+	timeUnits := s.new.RecordedLength * 60 / (encSlices + 1)
 	samples := make([]int64, s.settings.SampleCount)
 
 	// Start at half the time unit to avoid hitting opening sequences / black screens in movies
 	position := timeUnits / 2
-	encSeconds := float64(s.duplicate.RecordedLength) * float64(s.settings.Fraction) * 0.01 * 60
+	encSeconds := float64(s.new.RecordedLength) * float64(s.settings.Fraction) * 0.01 * 60
 	secondsPerEncSlice := int(math.Ceil(encSeconds / float64(encSlices)))
 	if secondsPerEncSlice < 60 {
 		secondsPerEncSlice = 60
 	}
 	// If the total encoding time in minutes is greater or equal to size, encode the whole thing
 	encodingDuration := time.Second * time.Duration(secondsPerEncSlice) * time.Duration(encSlices)
-	if encodingDuration >= time.Minute*time.Duration(s.duplicate.RecordedLength) {
+	if encodingDuration >= time.Minute*time.Duration(s.new.RecordedLength) {
 		encSlices = 1
 		position = 0
 		timeUnits = 0
-		secondsPerEncSlice = s.duplicate.RecordedLength * 60
+		secondsPerEncSlice = s.new.RecordedLength * 60
 	} else if secondsPerEncSlice > timeUnits {
 		_ = glg.Warnf("overlap detected with slice length %d, adjusted seconds per slice to %d", secondsPerEncSlice, timeUnits)
 		secondsPerEncSlice = timeUnits
 	}
 
-	// encode all slices and get sample file sizes
+	// encode all slices and get sample file sizes, up to Concurrency slices at once
+	concurrency := s.settings.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slices := make([]*globalstate.SliceProgress, len(samples))
+	for idx := range slices {
+		slices[idx] = &globalstate.SliceProgress{Slice: idx + 1}
+	}
+	state.Encoder.Slices = slices
+	errs := make([]error, len(samples))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	// slices that are still waiting are dropped once one has failed
+	var failed atomic.Bool
 	for idx := range samples {
-		state.Encoder.Slice = idx + 1
-		stats, err := encoder.Encode(s.new, position, secondsPerEncSlice, true, nil)
-		if err != nil {
-			_ = glg.Errorf("error encoding %s for estimation, output path %s, err: %s",
-				s.duplicate.Path, stats.OutputPath, err)
-			return -1, -1, -1, err
-		}
-		outFile, err := os.Stat(stats.OutputPath)
-		if err != nil {
-			_ = glg.Errorf("could not open estimation file %s, err: %s", stats.OutputPath, err)
-		}
-		samples[idx] = outFile.Size()
-		err = os.Remove(stats.OutputPath)
-		if err != nil {
-			_ = glg.Warnf("could not delete estimation file %s, err: %s", stats.OutputPath, err)
-		}
+		wg.Add(1)
+		go func(idx int, position int) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			if failed.Load() {
+				return
+			}
+			slices[idx].SetActive(true)
+			defer slices[idx].SetActive(false)
+			stats, err := encoder.EncodeSlice(s.new, position, secondsPerEncSlice, slices[idx])
+			if err != nil {
+				_ = glg.Errorf("error encoding %s for estimation, output path %s, err: %s",
+					s.new.Path, stats.OutputPath, err)
+				errs[idx] = err
+				failed.Store(true)
+				return
+			}
+			outFile, err := os.Stat(stats.OutputPath)
+			if err != nil {
+				_ = glg.Errorf("could not open estimation file %s, err: %s", stats.OutputPath, err)
+				errs[idx] = err
+				failed.Store(true)
+				return
+			}
+			samples[idx] = outFile.Size()
+			err = os.Remove(stats.OutputPath)
+			if err != nil {
+				_ = glg.Warnf("could not delete estimation file %s, err: %s", stats.OutputPath, err)
+			}
+			slices[idx].SetDone()
+			mutex.Lock()
+			state.Encoder.Slice++
+			mutex.Unlock()
+		}(idx, position)
 		// advance position for each slice
 		position += timeUnits
 	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return -1, err
+		}
+	}
 
 	var avg float64
 	for _, sample := range samples {
@@ -142,7 +229,11 @@ func (s *SizeApproxModule) estimate() (int64, int64, int, error) {
 	// avg slice size per minute
 	avg /= float64(secondsPerEncSlice)
 	avg *= 60
-	estimatedFileSize := int64(math.Ceil(avg * float64(s.duplicate.RecordedLength)))
+	return avg, nil
+}
+
+// compare returns (estimatedSize, duplicateSize, differenceFraction, err) for an estimated size of the new file
+func (s *SizeApproxModule) compare(estimatedFileSize int64) (int64, int64, int, error) {
 	duplicateFileSize, err := os.Stat(s.duplicate.Path)
 	if err != nil {
 		_ = glg.Errorf("could not read original file %s, err: %s", s.duplicate.Path, err)
@@ -151,3 +242,35 @@ func (s *SizeApproxModule) estimate() (int64, int64, int, error) {
 	difference := 100 - ((float64(estimatedFileSize) / float64(duplicateFileSize.Size())) * 100)
 	return estimatedFileSize, duplicateFileSize.Size(), int(difference), nil
 }
+
+// predict returns the size of the new file predicted by the size model for the duplicate's length
+//
+// It fails if there is no model or its prediction interval is wider than the configured maximum
+func (s *SizeApproxModule) predict() (int64, bool) {
+	model := GetSizeModel()
+	if model == nil || s.settings.ModelMaxInterval <= 0 || s.new.RecordedLength <= 0 || s.duplicate.RecordedLength <= 0 {
+		return 0, false
+	}
+	profiles, err := encoder.Profiles(s.new)
+	if err != nil {
+		return 0, false
+	}
+	source, err := os.Stat(s.new.Path)
+	if err != nil {
+		return 0, false
+	}
+	// the source bitrate is taken from the new file, the size is predicted for the duplicate's length
+	duration := float64(s.new.RecordedLength * 60)
+	prediction, err := model.Predict(s.new.Resolution.Tag, profiles[0].Name, duration, source.Size(), s.settings.ModelMinSamples)
+	if err != nil {
+		_ = glg.Infof("approx module: no size prediction (%d samples): %s", prediction.Samples, err)
+		return 0, false
+	}
+	_ = glg.Infof("approx module: predicted %s ±%.1f%% from %d samples",
+		tools.ByteCountSI(prediction.Size), prediction.Interval, prediction.Samples)
+	if prediction.Interval > float64(s.settings.ModelMaxInterval) {
+		_ = glg.Infof("approx module: prediction interval wider than %d%%, encoding slices", s.settings.ModelMaxInterval)
+		return 0, false
+	}
+	return int64(math.Ceil(float64(prediction.Size) * float64(s.duplicate.RecordedLength) / float64(s.new.RecordedLength))), true
+}
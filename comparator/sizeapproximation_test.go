@@ -0,0 +1,170 @@
+package comparator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/encoder"
+	"github.com/Spiritreader/avior-go/media"
+	"github.com/Spiritreader/avior-go/structs"
+)
+
+func TestSizeApproxParallelSlices(t *testing.T) {
+	fake := &encoder.Fake{BytesPerSecond: 1000, Valid: true}
+	encoder.SetBackend(fake)
+	defer encoder.SetBackend(&encoder.FFmpeg{})
+
+	dir := t.TempDir()
+	cfg := config.Instance()
+	cfg.Local.EncoderConfig = map[string]config.EncoderConfig{"hd": {OutDirectory: dir}}
+	newFile := media.File{Path: filepath.Join(dir, "new.ts"), RecordedLength: 60, Resolution: media.Resolution{Tag: "hd"}}
+	duplicate := media.File{Path: filepath.Join(dir, "old.mkv"), RecordedLength: 60}
+	if err := os.WriteFile(duplicate.Path, make([]byte, 10_000_000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	module := &SizeApproxModule{}
+	module.Init(config.ModuleConfig{Enabled: true, Settings: map[string]interface{}{
+		"Difference": 20, "SampleCount": 4, "Fraction": 10, "Concurrency": 4,
+	}})
+	_, result, message := module.Run(newFile, duplicate)
+	// 4 slices of 90 seconds at 1000 bytes per second estimate 3.6 MB
+	if result != REPL || message != "new/old: ratio: 3.60 MB/10.00 MB: 64 (estimated)" {
+		t.Errorf("Run() = %s, %s", result, message)
+	}
+	calls := fake.Calls()
+	if len(calls) != 4 {
+		t.Fatalf("expected 4 slice encodes, got %d", len(calls))
+	}
+	starts := make(map[int]bool)
+	for _, call := range calls {
+		starts[call.Start] = true
+		if call.Duration != 90 || call.Slice == nil || call.Slice.Progress != 100 {
+			t.Errorf("unexpected slice encode %+v", call)
+		}
+	}
+	for _, start := range []int{360, 1080, 1800, 2520} {
+		if !starts[start] {
+			t.Errorf("no slice encoded at %d", start)
+		}
+	}
+	if entries, _ := filepath.Glob(filepath.Join(dir, "*.estimate.mkv")); len(entries) != 0 {
+		t.Errorf("estimation files have not been removed: %v", entries)
+	}
+
+	// waiting slices are dropped after the first failure
+	failing := &encoder.Fake{ExitCode: 1}
+	encoder.SetBackend(failing)
+	ResetEstimates()
+	defer ResetEstimates()
+	module.Init(config.ModuleConfig{Enabled: true, Settings: map[string]interface{}{
+		"Difference": 20, "SampleCount": 4, "Fraction": 10, "Concurrency": 1,
+	}})
+	module.Run(newFile, duplicate)
+	if calls := failing.Calls(); len(calls) != 1 {
+		t.Errorf("expected encoding to stop after the failed slice, got %d encodes", len(calls))
+	}
+}
+
+func TestSizeApproxEstimateOncePerJob(t *testing.T) {
+	fake := &encoder.Fake{BytesPerSecond: 1000, Valid: true}
+	encoder.SetBackend(fake)
+	defer encoder.SetBackend(&encoder.FFmpeg{})
+	ResetEstimates()
+	defer ResetEstimates()
+
+	dir := t.TempDir()
+	cfg := config.Instance()
+	cfg.Local.EncoderConfig = map[string]config.EncoderConfig{"hd": {OutDirectory: dir}}
+	newFile := media.File{Path: filepath.Join(dir, "new.ts"), RecordedLength: 60, Resolution: media.Resolution{Tag: "hd"}}
+	duplicates := []media.File{
+		{Path: filepath.Join(dir, "old.mkv"), RecordedLength: 60},
+		{Path: filepath.Join(dir, "older.mkv"), RecordedLength: 30},
+	}
+	for _, duplicate := range duplicates {
+		if err := os.WriteFile(duplicate.Path, make([]byte, 10_000_000), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	module := &SizeApproxModule{}
+	module.Init(config.ModuleConfig{Enabled: true, Settings: map[string]interface{}{
+		"Difference": 20, "SampleCount": 4, "Fraction": 10, "Concurrency": 4,
+	}})
+	// the estimate of the new file is scaled to the length of each duplicate
+	wants := []string{"3.60 MB/10.00 MB", "1.80 MB/10.00 MB"}
+	for idx, duplicate := range duplicates {
+		if _, _, message := module.Run(newFile, duplicate); !strings.Contains(message, wants[idx]) {
+			t.Errorf("Run() with %s = %s, want %s", duplicate.Path, message, wants[idx])
+		}
+	}
+	if calls := fake.Calls(); len(calls) != 4 {
+		t.Errorf("expected the slices to be encoded once, got %d slice encodes", len(calls))
+	}
+}
+
+type memorySampleStore struct {
+	samples []structs.SizeSample
+}
+
+func (m *memorySampleStore) InsertSizeSample(sample *structs.SizeSample) error {
+	m.samples = append(m.samples, *sample)
+	return nil
+}
+
+func (m *memorySampleStore) GetSizeSamples(tag string, profile string, limit int64) ([]structs.SizeSample, error) {
+	found := make([]structs.SizeSample, 0)
+	for _, sample := range m.samples {
+		if sample.Tag == tag && sample.Profile == profile {
+			found = append(found, sample)
+		}
+	}
+	return found, nil
+}
+
+func TestSizeApproxModelPrediction(t *testing.T) {
+	fake := &encoder.Fake{BytesPerSecond: 1000, Valid: true}
+	encoder.SetBackend(fake)
+	defer encoder.SetBackend(&encoder.FFmpeg{})
+	model := NewSizeModel(&memorySampleStore{})
+	SetSizeModel(model)
+	defer SetSizeModel(nil)
+
+	// output rate is a fifth of the source rate with a little noise
+	for idx := 0; idx < 30; idx++ {
+		sourceSize := int64(1_000_000_000 + idx*10_000_000)
+		noise := int64(idx%3-1) * 1_000_000
+		if err := model.Record("hd", "default", 3600, sourceSize, sourceSize/5+noise); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	cfg := config.Instance()
+	cfg.Local.EncoderConfig = map[string]config.EncoderConfig{"hd": {OutDirectory: dir}}
+	newFile := media.File{Path: filepath.Join(dir, "new.ts"), RecordedLength: 60, Resolution: media.Resolution{Tag: "hd"}}
+	duplicate := media.File{Path: filepath.Join(dir, "old.mkv"), RecordedLength: 60}
+	for path, size := range map[string]int64{newFile.Path: 1_200_000_000, duplicate.Path: 300_000_000} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(path, size); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	module := &SizeApproxModule{}
+	module.Init(config.ModuleConfig{Enabled: true, Settings: map[string]interface{}{
+		"Difference": 10, "SampleCount": 4, "Fraction": 10, "ModelMaxInterval": 5, "ModelMinSamples": 20,
+	}})
+	_, result, message := module.Run(newFile, duplicate)
+	if result != REPL || !strings.HasPrefix(message, "new/old: ratio: 240.0") || !strings.HasSuffix(message, "(predicted)") {
+		t.Errorf("Run() = %s, %s", result, message)
+	}
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Errorf("expected no slice encodes, got %d", len(calls))
+	}
+}
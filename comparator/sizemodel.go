@@ -0,0 +1,135 @@
+package comparator
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Spiritreader/avior-go/structs"
+)
+
+// z value of a 95% prediction interval
+const predictionZ = 1.96
+
+var ErrNotEnoughSamples = errors.New("not enough size samples")
+
+// SizeSampleStore persists the samples of the size model
+type SizeSampleStore interface {
+	InsertSizeSample(sample *structs.SizeSample) error
+	GetSizeSamples(tag string, profile string, limit int64) ([]structs.SizeSample, error)
+}
+
+// SizeModel predicts output sizes from the sizes of past encodes.
+//
+// Per resolution tag and encoder profile, the output bitrate is fitted linearly to the source bitrate
+type SizeModel struct {
+	store SizeSampleStore
+	// MaxSamples is the number of recent samples a prediction is based on
+	MaxSamples int64
+}
+
+// Prediction is the predicted output size and the half width of its 95% interval in percent of the size
+type Prediction struct {
+	Size     int64
+	Interval float64
+	Samples  int
+}
+
+var (
+	sizeModel      *SizeModel
+	sizeModelMutex sync.RWMutex
+)
+
+func NewSizeModel(store SizeSampleStore) *SizeModel {
+	return &SizeModel{store: store, MaxSamples: 500}
+}
+
+// SetSizeModel sets the model used by the SizeApproxModule, nil disables predictions
+func SetSizeModel(model *SizeModel) {
+	sizeModelMutex.Lock()
+	defer sizeModelMutex.Unlock()
+	sizeModel = model
+}
+
+// GetSizeModel returns the model used by the SizeApproxModule, nil if there is none
+func GetSizeModel() *SizeModel {
+	sizeModelMutex.RLock()
+	defer sizeModelMutex.RUnlock()
+	return sizeModel
+}
+
+// Record adds a finished encode of duration seconds to the model
+func (m *SizeModel) Record(tag string, profile string, duration float64, sourceSize int64, outputSize int64) error {
+	if duration <= 0 || sourceSize <= 0 || outputSize <= 0 {
+		return errors.New("size sample needs a positive duration and sizes")
+	}
+	return m.store.InsertSizeSample(&structs.SizeSample{
+		Tag:           tag,
+		Profile:       profile,
+		Duration:      duration,
+		SourceBitrate: bitrate(sourceSize, duration),
+		OutputSize:    outputSize,
+		Recorded:      time.Now(),
+	})
+}
+
+// Predict estimates the output size of an encode of duration seconds from a source of sourceSize bytes
+func (m *SizeModel) Predict(tag string, profile string, duration float64, sourceSize int64, minSamples int) (Prediction, error) {
+	if duration <= 0 || sourceSize <= 0 {
+		return Prediction{}, errors.New("prediction needs a positive duration and source size")
+	}
+	samples, err := m.store.GetSizeSamples(tag, profile, m.MaxSamples)
+	if err != nil {
+		return Prediction{}, err
+	}
+	if len(samples) < minSamples || len(samples) < 3 {
+		return Prediction{Samples: len(samples)}, ErrNotEnoughSamples
+	}
+
+	// least squares fit of the output rate in bytes per second to the source bitrate
+	n := float64(len(samples))
+	var meanX, meanY float64
+	for _, sample := range samples {
+		meanX += sample.SourceBitrate / n
+		meanY += float64(sample.OutputSize) / sample.Duration / n
+	}
+	var sxx, sxy float64
+	for _, sample := range samples {
+		dx := sample.SourceBitrate - meanX
+		sxx += dx * dx
+		sxy += dx * (float64(sample.OutputSize)/sample.Duration - meanY)
+	}
+	slope := 0.0
+	if sxx > 0 {
+		slope = sxy / sxx
+	}
+	intercept := meanY - slope*meanX
+	var residuals float64
+	for _, sample := range samples {
+		residual := float64(sample.OutputSize)/sample.Duration - (intercept + slope*sample.SourceBitrate)
+		residuals += residual * residual
+	}
+	stdErr := math.Sqrt(residuals / (n - 2))
+
+	x := bitrate(sourceSize, duration)
+	rate := intercept + slope*x
+	if rate <= 0 {
+		return Prediction{Samples: len(samples)}, errors.New("source bitrate is outside of the model")
+	}
+	leverage := 1 + 1/n
+	if sxx > 0 {
+		leverage += (x - meanX) * (x - meanX) / sxx
+	}
+	interval := predictionZ * stdErr * math.Sqrt(leverage)
+	return Prediction{
+		Size:     int64(math.Ceil(rate * duration)),
+		Interval: interval / rate * 100,
+		Samples:  len(samples),
+	}, nil
+}
+
+// bitrate returns the bitrate in kbit/s of size bytes over duration seconds
+func bitrate(size int64, duration float64) float64 {
+	return float64(size) * 8 / 1000 / duration
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -36,6 +37,17 @@ type Local struct {
 	Modules            map[string]ModuleConfig
 	EncoderConfig      map[string]EncoderConfig
 	EncoderPriority    string
+	QualityGate        QualityGate
+	Verification       Verification
+	Trimming           Trimming
+	Metadata           Metadata
+	DuplicateMatching  DuplicateMatching
+	// ObsoleteInferiorDuplicates moves duplicates that are worse than the best copy to the obsolete path
+	ObsoleteInferiorDuplicates bool
+	LibraryIndex               LibraryIndex
+	LibraryWalk                LibraryWalk
+	ShareMonitor               ShareMonitor
+	Retention                  Retention
 }
 
 type Redis struct {
@@ -47,6 +59,122 @@ type Redis struct {
 	ChannelPrefix string
 }
 
+// QualityGate compares samples of the encoded output with the source after an encode.
+//
+// Encodes scoring below any of the minimums count as failed, a minimum of 0 disables that metric
+type QualityGate struct {
+	Enabled bool
+	// Samples is the number of segments that are compared
+	Samples int
+	// SampleLength is the length of a segment in seconds
+	SampleLength int
+	MinSSIM      float64
+	MinPSNR      float64
+	// MinVMAF is only checked if ffmpeg has been built with libvmaf
+	MinVMAF float64
+}
+
+// Verification compares a finished encode with its source
+type Verification struct {
+	Enabled bool
+	// DurationTolerance is the number of seconds the output duration may differ from the source.
+	// The output may also not be shorter than the recorded length by more than a minute plus the tolerance
+	DurationTolerance int
+	// Streams compares the number of video, audio and subtitle streams with the streams mapped to the output
+	Streams bool
+	// Channels compares the channel count of each audio stream with the mapped source stream
+	Channels bool
+}
+
+// Trimming cuts the pre- and post-roll padding of recordings at black frames and silence.
+//
+// The cut points are chosen so the remaining duration matches the EPG length
+type Trimming struct {
+	Enabled bool
+	// SearchWindow is the number of seconds beyond the padding that are searched for cut points
+	SearchWindow int
+	// Tolerance is the number of seconds the trimmed duration may differ from the EPG length
+	Tolerance int
+	// MinBlack is the minimum black frame duration in seconds
+	MinBlack float64
+	// MinSilence is the minimum silence duration in seconds
+	MinSilence float64
+	// SilenceNoise is the noise level of silence, for example -50dB
+	SilenceNoise string
+}
+
+// Metadata is muxed into full encodes
+type Metadata struct {
+	// Chapters are created from the VDR marks file next to the recording
+	Chapters bool
+	// EpgTags sets the title, description and episode tags from the metadata log
+	EpgTags bool
+	// AviorTags records the origin of the encode, the duplicate modules read them if a file has no logs
+	AviorTags bool
+}
+
+// DuplicateMatching finds duplicates whose names differ from the output name of a job
+type DuplicateMatching struct {
+	// Normalized ignores case, punctuation and umlaut spelling
+	Normalized bool
+	// FuzzyThreshold is the minimum similarity of normalized names from 0 to 1, 0 disables fuzzy matching
+	FuzzyThreshold float64
+	// EventIDs matches files that have the same EPG event id in their metadata logs
+	EventIDs bool
+	// EventIDMinSimilarity is the name similarity a file needs before its metadata log is read for the event id
+	EventIDMinSimilarity float64
+}
+
+// LibraryIndex keeps the files of the media paths in a persistent index instead of walking them for every job
+type LibraryIndex struct {
+	Enabled bool
+	// Watch updates the index from filesystem notifications, network shares may not deliver them
+	Watch bool
+	// RescanInterval is the time between rescans, they only list directories whose modification time changed
+	RescanInterval time.Duration
+}
+
+// LibraryWalk controls how the media paths are walked for duplicates without a library index
+type LibraryWalk struct {
+	// Concurrency is the number of media paths that are walked at the same time
+	Concurrency int
+	// Timeout skips media paths whose walk takes longer, 0 disables it.
+	// The library cache isn't filled if a path has been skipped
+	Timeout time.Duration
+}
+
+// ShareMonitor pauses the service while a media path, the obsolete path or an encoder output directory is unreachable
+// and resumes it once they are all back
+type ShareMonitor struct {
+	Enabled  bool
+	Interval time.Duration
+	// Timeout is the time a location may take to respond before it counts as unreachable
+	Timeout time.Duration
+}
+
+// Retention deletes the oldest files of the obsolete, done and exists directories once a policy is exceeded
+type Retention struct {
+	Enabled bool
+	// DryRun only reports the files that would have been deleted
+	DryRun   bool
+	Interval time.Duration
+	// Roots are searched for done and exists directories in addition to the directories of all jobs
+	Roots    []string
+	Obsolete RetentionPolicy
+	Done     RetentionPolicy
+	Exists   RetentionPolicy
+}
+
+// RetentionPolicy limits the files of a directory kind, a limit of 0 is disabled
+type RetentionPolicy struct {
+	// MaxAge is the number of days a file is kept
+	MaxAge int
+	// MaxSize is the total size of all directories of the kind in GB
+	MaxSize float64
+	// MinFreeSpace is the free space in GB that is kept on the drive of each directory
+	MinFreeSpace float64
+}
+
 type Shared struct {
 	NameExclude []string
 	SubExclude  []string
@@ -97,6 +225,12 @@ type SizeApproxModuleSettings struct {
 	Difference  int
 	SampleCount int
 	Fraction    int
+	// Concurrency is the number of slices that are encoded at the same time
+	Concurrency int
+	// ModelMaxInterval is the widest prediction interval of the size model in percent that is used instead of encoding slices, 0 disables the model
+	ModelMaxInterval int
+	// ModelMinSamples is the number of past encodes the size model needs for a prediction
+	ModelMinSamples int
 }
 
 type ErrorModuleSettings struct {
@@ -104,12 +238,62 @@ type ErrorModuleSettings struct {
 }
 
 type EncoderConfig struct {
-	OutDirectory     string
+	OutDirectory string
+	// EncoderProfile holds the arguments of the first profile, its fields are stored inline
+	EncoderProfile
+	Stash []string
+	// Fallbacks are tried in order if an encode with the arguments above fails
+	Fallbacks []EncoderProfile
+	// StreamPolicy selects the streams of all profiles, it is ignored for custom parameters
+	StreamPolicy StreamPolicy
+}
+
+// StreamPolicy generates -map arguments from the streams of the source
+type StreamPolicy struct {
+	Enabled bool
+	// AudioLanguages keeps audio streams in these ISO 639-2 languages, all audio streams are kept if it is empty
+	AudioLanguages []string
+	// KeepSubtitles keeps DVB subtitle streams
+	KeepSubtitles bool
+	// KeepTeletext converts teletext streams to srt, which requires ffmpeg with libzvbi
+	KeepTeletext bool
+	// DropAudioDescription drops audio streams for the visually impaired
+	DropAudioDescription bool
+}
+
+// EncoderProfile is an argument set of an encoder config
+type EncoderProfile struct {
+	// Name names the profile in job logs
+	Name             string
 	PreArguments     []string
 	PostArguments    []string
-	Stash            []string
 	StereoArguments  []string
 	MultiChArguments []string
+	// Mode is one of arguments, bitrate or size.
+	// bitrate and size modes run a two-pass encode with an average video bitrate
+	Mode string
+	// TargetBitrate is the average video bitrate in kbit/s for the bitrate mode
+	TargetBitrate int
+	// TargetSize is the output size in MB for the size mode, the bitrate is derived from the recorded length
+	TargetSize int
+	// AudioBitrate in kbit/s is subtracted from the bitrate derived in size mode
+	AudioBitrate int
+}
+
+// Profiles returns the ordered encoder profiles of the config, starting with its own arguments
+func (e EncoderConfig) Profiles() []EncoderProfile {
+	profile := e.EncoderProfile
+	if len(profile.Name) == 0 {
+		profile.Name = "default"
+	}
+	profiles := []EncoderProfile{profile}
+	for idx, fallback := range e.Fallbacks {
+		if len(fallback.Name) == 0 {
+			fallback.Name = fmt.Sprintf("fallback %d", idx+1)
+		}
+		profiles = append(profiles, fallback)
+	}
+	return profiles
 }
 
 const (
@@ -174,6 +358,50 @@ func InitWithDefaults(cfg *Data) {
 	cfg.Local.Resolutions = map[string]string{"hd": "1280x720", "fhd": "1920x1080"}
 	cfg.Local.EncoderConfig = map[string]EncoderConfig{"hd": *new(EncoderConfig)}
 	cfg.Local.EncoderPriority = PRIORITY_IDLE.String()
+	cfg.Local.QualityGate = QualityGate{
+		Enabled:      false,
+		Samples:      3,
+		SampleLength: 10,
+		MinSSIM:      0.95,
+	}
+	cfg.Local.Verification = Verification{
+		Enabled:           false,
+		DurationTolerance: 5,
+	}
+	cfg.Local.Trimming = Trimming{
+		Enabled:      false,
+		SearchWindow: 300,
+		Tolerance:    180,
+		MinBlack:     0.4,
+		MinSilence:   0.3,
+		SilenceNoise: "-50dB",
+	}
+	cfg.Local.Metadata = Metadata{
+		AviorTags: true,
+	}
+	cfg.Local.DuplicateMatching = DuplicateMatching{
+		Normalized:           false,
+		EventIDs:             false,
+		EventIDMinSimilarity: 0.5,
+	}
+	cfg.Local.LibraryIndex = LibraryIndex{
+		Enabled:        false,
+		Watch:          false,
+		RescanInterval: 15 * time.Minute,
+	}
+	cfg.Local.LibraryWalk = LibraryWalk{
+		Concurrency: 2,
+		Timeout:     15 * time.Minute,
+	}
+	cfg.Local.ShareMonitor = ShareMonitor{
+		Enabled:  false,
+		Interval: time.Minute,
+		Timeout:  10 * time.Second,
+	}
+	cfg.Local.Retention = Retention{
+		DryRun:   true,
+		Interval: time.Hour,
+	}
 	cfg.Local.Redis = Redis{
 		Host:          "localhost:6379",
 		Password:      "",
@@ -222,7 +450,8 @@ func InitWithDefaults(cfg *Data) {
 	moduleConfig = &ModuleConfig{
 		Enabled:  false,
 		Priority: 0,
-		Settings: &SizeApproxModuleSettings{Difference: 20, Fraction: 5, SampleCount: 2},
+		Settings: &SizeApproxModuleSettings{Difference: 20, Fraction: 5, SampleCount: 2, Concurrency: 1,
+			ModelMaxInterval: 10, ModelMinSamples: 20},
 	}
 	cfg.Local.Modules[consts.MODULE_NAME_SIZEAPPROX] = *moduleConfig
 	// ResolutionModule Config Defaults
@@ -18,6 +18,7 @@ const (
 	AUDIO_ACC_HIGH                   string = "high"
 	PAUSE_REASON_DUPLICATE_SCAN      string = "DuplicateScanFail"
 	PAUSE_REASON_ENCODE_ERROR        string = "EncodeError"
+	PAUSE_REASON_SHARE_UNREACHABLE   string = "ShareUnreachable"
 	LOG_DELIM                        string = "avior-go info"
 	LOGMATCH_MODE_INCLUDE            string = "include"
 	LOGMATCH_MODE_NEUTRAL            string = "neutral"
@@ -32,4 +33,43 @@ const (
 	DELETE                           string = "delete"
 	GET                              string = "GE"
 	DB_NAME                          string = "Avior"
+	JOB_STATUS_QUEUED                string = "queued"
+	JOB_STATUS_CLAIMED               string = "claimed"
+	JOB_STATUS_SCANNING              string = "scanning"
+	JOB_STATUS_ESTIMATING            string = "estimating"
+	JOB_STATUS_ENCODING              string = "encoding"
+	JOB_STATUS_MOVING                string = "moving"
+	JOB_STATUS_DONE                  string = "done"
+	JOB_STATUS_SKIPPED               string = "skipped"
+	JOB_STATUS_FAILED                string = "failed"
+	JOURNAL_STEP_DUPLICATES_MOVED    string = "DuplicatesMoved"
+	JOURNAL_STEP_ENCODE_STARTED      string = "EncodeStarted"
+	JOURNAL_STEP_ENCODE_FINISHED     string = "EncodeFinished"
+	JOURNAL_STEP_SOURCE_MOVED        string = "SourceMoved"
+	CANCEL_ACTION_REQUEUE            string = "requeue"
+	CANCEL_ACTION_SKIP               string = "skip"
+	ENCODE_MODE_ARGUMENTS            string = "arguments"
+	ENCODE_MODE_BITRATE              string = "bitrate"
+	ENCODE_MODE_SIZE                 string = "size"
+	TAG_SOURCE                       string = "AVIOR_SOURCE"
+	TAG_HOST                         string = "AVIOR_HOST"
+	TAG_REPLACEMENT                  string = "AVIOR_REPLACEMENT"
+	TAG_PROFILE                      string = "AVIOR_PROFILE"
+	TAG_ENCODED                      string = "AVIOR_ENCODED"
+	TAG_RECORDED_LENGTH              string = "AVIOR_RECORDED_LENGTH"
+	TAG_LENGTH                       string = "AVIOR_LENGTH"
+	TAG_ERRORS                       string = "AVIOR_ERRORS"
+	TAG_AUDIO_FORMAT                 string = "AVIOR_AUDIO_FORMAT"
+	TAG_RESOLUTION                   string = "AVIOR_RESOLUTION"
+	MATCH_EXACT                      string = "exact"
+	MATCH_NORMALIZED                 string = "normalized"
+	MATCH_EVENT_ID                   string = "eventid"
+	MATCH_FUZZY                      string = "fuzzy"
+	LIBRARY_ADD                      string = "add"
+	LIBRARY_REMOVE                   string = "remove"
+	LIBRARY_MOVE                     string = "move"
+	LIBRARY_SNAPSHOT                 string = "snapshot"
+	SHARE_KIND_MEDIA                 string = "media"
+	SHARE_KIND_OBSOLETE              string = "obsolete"
+	SHARE_KIND_OUTPUT                string = "output"
 )
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/Spiritreader/avior-go/structs"
+	"github.com/kpango/glg"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SetJobStatus updates the lifecycle state of a job in the queue
+func (ds *DataStore) SetJobStatus(job *structs.Job, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	_, err := ds.Db().Collection("jobs").UpdateOne(ctx, bson.M{"_id": job.ID}, bson.M{"$set": bson.M{"Status": status}})
+	if err != nil {
+		_ = glg.Errorf("could not set status of job %s to %s: %s", job.Name, status, err)
+		return err
+	}
+	job.Status = status
+	return nil
+}
+
+// InsertJobHistory stores the record of a finished job
+func (ds *DataStore) InsertJobHistory(entry *structs.JobHistory) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	entry.ID = primitive.NewObjectID()
+	_, err := ds.Db().Collection("job_history").InsertOne(ctx, entry)
+	if err != nil {
+		_ = glg.Errorf("could not insert history for job %s: %s", entry.Name, err)
+		return err
+	}
+	_ = glg.Infof("recorded history for job %s (%s)", entry.Name, entry.Status)
+	return nil
+}
+
+// GetJobHistory retrieves finished jobs, newest first
+//
+// path and name are optional case insensitive substrings to filter by, limit <= 0 returns all entries
+func (ds *DataStore) GetJobHistory(path string, name string, limit int64) ([]structs.JobHistory, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	filter := bson.M{}
+	if len(path) > 0 {
+		filter["Path"] = primitive.Regex{Pattern: regexp.QuoteMeta(path), Options: "i"}
+	}
+	if len(name) > 0 {
+		filter["Name"] = primitive.Regex{Pattern: regexp.QuoteMeta(name), Options: "i"}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "Finished", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	historyCursor, err := ds.Db().Collection("job_history").Find(ctx, filter, opts)
+	if err != nil {
+		_ = glg.Errorf("could not retrieve job history: %s", err)
+		return nil, err
+	}
+	defer historyCursor.Close(ctx)
+	history := make([]structs.JobHistory, 0)
+	err = historyCursor.All(ctx, &history)
+	if err != nil {
+		_ = glg.Errorf("could not read job history: %s", err)
+		return nil, err
+	}
+	return history, nil
+}
+
+// GetJobHistoryEntry retrieves a single history entry by its id or the id of the job it belongs to
+//
+// nil will be returned if no entry exists
+func (ds *DataStore) GetJobHistoryEntry(id string) (*structs.JobHistory, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	poid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "Finished", Value: -1}})
+	var result *structs.JobHistory
+	err = ds.Db().Collection("job_history").FindOne(ctx, bson.M{"$or": bson.A{bson.M{"_id": poid}, bson.M{"JobID": poid}}}, opts).Decode(&result)
+	if err != mongo.ErrNoDocuments && err != nil {
+		_ = glg.Errorf("could not retrieve job history entry %s: %s", id, err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetJobDirectories returns the directories of all queued and finished jobs
+func (ds *DataStore) GetJobDirectories() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	seen := make(map[string]bool)
+	dirs := make([]string, 0)
+	for _, collection := range []string{"jobs", "job_history"} {
+		paths, err := ds.Db().Collection(collection).Distinct(ctx, "Path", bson.D{})
+		if err != nil {
+			_ = glg.Errorf("could not retrieve job paths from %s: %s", collection, err)
+			return nil, err
+		}
+		for _, path := range paths {
+			if path, ok := path.(string); ok && len(path) > 0 && !seen[filepath.Dir(path)] {
+				seen[filepath.Dir(path)] = true
+				dirs = append(dirs, filepath.Dir(path))
+			}
+		}
+	}
+	return dirs, nil
+}
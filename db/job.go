@@ -3,14 +3,18 @@ package db
 import (
 	"context"
 	"fmt"
+	"os"
+	"regexp"
 	"time"
 
 	"github.com/Spiritreader/avior-go/consts"
+	"github.com/Spiritreader/avior-go/globalstate"
 	"github.com/Spiritreader/avior-go/structs"
 	"github.com/kpango/glg"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // GetJAllJobs gets all jobs
@@ -19,7 +23,7 @@ import (
 func (ds *DataStore) GetAllJobs() ([]structs.Job, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
-	clientCursor, err := ds.Db().Collection("jobs").Find(ctx, bson.D{})
+	clientCursor, err := ds.Db().Collection("jobs").Find(ctx, bson.D{}, options.Find().SetSort(queueOrder))
 	if err != nil {
 		_ = glg.Errorf("could not retrieve jobs: %s", err)
 		return nil, err
@@ -43,7 +47,7 @@ func (ds *DataStore) GetAllJobs() ([]structs.Job, error) {
 func (ds *DataStore) GetJobsForClient(client structs.Client) ([]structs.Job, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
-	clientCursor, err := ds.Db().Collection("jobs").Find(ctx, bson.M{"AssignedClient.$id": client.ID})
+	clientCursor, err := ds.Db().Collection("jobs").Find(ctx, bson.M{"AssignedClient.$id": client.ID}, options.Find().SetSort(queueOrder))
 	if err != nil {
 		_ = glg.Errorf("could not retrieve jobs for client %s: %s", client.Name, err)
 		return nil, err
@@ -64,18 +68,52 @@ func (ds *DataStore) GetJobsForClient(client structs.Client) ([]structs.Job, err
 	return jobs, nil
 }
 
-// GetNextJobForClient returns the next available job in the queue for a given client
+// JobLease is the duration a claimed job stays reserved for the claiming instance.
+//
+// The lease is renewed periodically while the job is being processed, see KeepJobLease
+var JobLease = 10 * time.Minute
+
+// inFlightStatuses are the states of jobs that are currently held by an instance
+var inFlightStatuses = bson.A{
+	consts.JOB_STATUS_CLAIMED,
+	consts.JOB_STATUS_SCANNING,
+	consts.JOB_STATUS_ESTIMATING,
+	consts.JOB_STATUS_ENCODING,
+	consts.JOB_STATUS_MOVING,
+}
+
+// queueOrder is the order in which queued jobs are picked: highest priority first, then first in first out
+var queueOrder = bson.D{{Key: "Priority", Value: -1}, {Key: "EnqueuedAt", Value: 1}, {Key: "_id", Value: 1}}
+
+// GetNextJobForClient atomically claims the next available job in the queue for a given client
+//
+// The job is marked as claimed by this instance and reserved until its lease expires.
+// Jobs with an expired lease are put back into the queue before claiming.
+//
+// Jobs are picked by priority and then in the order they were enqueued.
+// Jobs whose deadline has been reached are picked first, earliest deadline first.
+// Jobs that have a NotBefore time in the future are not eligible.
+//
+// Jobs pinned to the client are claimed first, unassigned jobs are pulled from the shared pool afterwards.
 //
 // nil will be returned if there are no more jobs available
 func (ds *DataStore) GetNextJobForClient(client *structs.Client) (*structs.Job, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-	var result *structs.Job
-	err := ds.Db().Collection("jobs").FindOne(ctx, bson.M{"AssignedClient.$id": client.ID}).Decode(&result)
-	if err != mongo.ErrNoDocuments && err != nil {
-		_ = glg.Errorf("could not retrieve next job for client %s: %s", client.Name, err)
+	if err := ds.RequeueExpiredJobs(); err != nil {
+		_ = glg.Warnf("could not requeue expired jobs: %s", err)
+	}
+	result, err := ds.claimJob(claimableFilter(bson.M{"AssignedClient.$id": client.ID}), nil)
+	if err != nil {
+		_ = glg.Errorf("could not claim next job for client %s: %s", client.Name, err)
 		return nil, err
 	}
+	if result == nil {
+		// pinned jobs always take precedence, fall back to the shared pool
+		result, err = ds.claimPoolJob(client)
+		if err != nil {
+			_ = glg.Errorf("could not claim pool job for client %s: %s", client.Name, err)
+			return nil, err
+		}
+	}
 	if result == nil {
 		return nil, nil
 	}
@@ -83,6 +121,224 @@ func (ds *DataStore) GetNextJobForClient(client *structs.Client) (*structs.Job,
 	return result, nil
 }
 
+// claimableFilter extends filter to match only jobs that are queued and allowed to start
+func claimableFilter(filter bson.M) bson.M {
+	filter["Status"] = bson.M{"$in": bson.A{consts.JOB_STATUS_QUEUED, nil}}
+	filter["$or"] = bson.A{
+		bson.M{"NotBefore": bson.M{"$exists": false}},
+		bson.M{"NotBefore": bson.M{"$lte": time.Now()}},
+	}
+	return filter
+}
+
+// claimJob claims the first job matching filter for this instance, overdue jobs take precedence
+//
+// set holds additional fields that are updated on the claimed job, it may be nil.
+//
+// nil will be returned if no job matches
+func (ds *DataStore) claimJob(filter bson.M, set bson.M) (*structs.Job, error) {
+	overdueFilter := bson.M{"Deadline": bson.M{"$lte": time.Now()}}
+	for k, v := range filter {
+		overdueFilter[k] = v
+	}
+	overdueOrder := append(bson.D{{Key: "Deadline", Value: 1}}, queueOrder...)
+	result, err := ds.claimFirst(overdueFilter, overdueOrder, set)
+	if err != nil || result != nil {
+		return result, err
+	}
+	return ds.claimFirst(filter, queueOrder, set)
+}
+
+func (ds *DataStore) claimFirst(filter bson.M, order bson.D, set bson.M) (*structs.Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	claim := bson.M{
+		"Status":      consts.JOB_STATUS_CLAIMED,
+		"ClaimedBy":   claimant(),
+		"LeaseExpiry": time.Now().Add(JobLease),
+	}
+	for k, v := range set {
+		claim[k] = v
+	}
+	update := bson.M{"$set": claim}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetSort(order)
+	var result *structs.Job
+	err := ds.Db().Collection("jobs").FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	_ = glg.Infof("claimed job %s as %s until %s", result.Name, result.ClaimedBy, result.LeaseExpiry.Format(time.RFC3339))
+	return result, nil
+}
+
+// RenewJobLease extends the lease of a job that has been claimed by this instance
+func (ds *DataStore) RenewJobLease(job *structs.Job) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	expiry := time.Now().Add(JobLease)
+	res, err := ds.Db().Collection("jobs").UpdateOne(ctx,
+		bson.M{"_id": job.ID, "Status": bson.M{"$in": inFlightStatuses}, "ClaimedBy": claimant()},
+		bson.M{"$set": bson.M{"LeaseExpiry": expiry}})
+	if err != nil {
+		_ = glg.Errorf("could not renew lease for job %s: %s", job.Name, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("job %s is no longer claimed by %s", job.Name, claimant())
+	}
+	job.LeaseExpiry = expiry
+	return nil
+}
+
+// KeepJobLease renews the lease of a claimed job in the background until the returned function is called
+func (ds *DataStore) KeepJobLease(job *structs.Job) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(JobLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := ds.RenewJobLease(job); err != nil {
+					_ = glg.Warnf("lease renewal failed, job may be picked up by another instance: %s", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// RequeueExpiredJobs puts all in-flight jobs whose lease has expired back into the queue
+func (ds *DataStore) RequeueExpiredJobs() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	// jobs that were pulled from the pool are returned to it
+	expired := bson.M{"Status": bson.M{"$in": inFlightStatuses}, "LeaseExpiry": bson.M{"$lt": time.Now()}}
+	_, err := ds.Db().Collection("jobs").UpdateMany(ctx,
+		bson.M{"Status": expired["Status"], "LeaseExpiry": expired["LeaseExpiry"], "Pooled": true},
+		bson.M{"$set": bson.M{"AssignedClient": poolRef()}})
+	if err != nil {
+		return err
+	}
+	res, err := ds.Db().Collection("jobs").UpdateMany(ctx, expired,
+		bson.M{
+			"$set":   bson.M{"Status": consts.JOB_STATUS_QUEUED},
+			"$unset": bson.M{"ClaimedBy": "", "LeaseExpiry": ""},
+		})
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount > 0 {
+		_ = glg.Infof("requeued %d jobs with expired leases", res.ModifiedCount)
+	}
+	return nil
+}
+
+// RequeueJob releases the claim on a job and puts it back into the queue
+func (ds *DataStore) RequeueJob(job *structs.Job) error {
+	return ds.requeueJob(job, bson.M{})
+}
+
+// RequeueJobLast releases the claim on a job and puts it back at the end of the queue,
+// so a cancelled job isn't picked up again right away
+func (ds *DataStore) RequeueJobLast(job *structs.Job) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	priority, err := ds.edgePriority(ctx, job.ID, false)
+	if err != nil {
+		_ = glg.Errorf("could not determine queue bounds for job %s: %s", job.Name, err)
+		return err
+	}
+	return ds.requeueJob(job, bson.M{"Priority": priority, "EnqueuedAt": time.Now()})
+}
+
+func (ds *DataStore) requeueJob(job *structs.Job, set bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	set["Status"] = consts.JOB_STATUS_QUEUED
+	if job.Pooled {
+		set["AssignedClient"] = poolRef()
+	}
+	// a job whose lease expired may have been claimed by another client in the meantime,
+	// the claim is released and the status set at once so the job is never queued while it is claimed
+	var result *structs.Job
+	err := ds.Db().Collection("jobs").FindOneAndUpdate(ctx, bson.M{"_id": job.ID, "ClaimedBy": claimedByThisClient()}, bson.M{
+		"$set":   set,
+		"$unset": bson.M{"ClaimedBy": "", "LeaseExpiry": ""},
+	}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		_ = glg.Warnf("job %s is not claimed by %s anymore, not requeueing", job.Name, globalstate.Instance().HostName)
+		return fmt.Errorf("job %s is not claimed by %s", job.Name, globalstate.Instance().HostName)
+	} else if err != nil {
+		_ = glg.Errorf("could not requeue job %s: %s", job.Name, err)
+		return err
+	}
+	job.Status = consts.JOB_STATUS_QUEUED
+	_ = glg.Infof("requeued job %s", job.Name)
+	return nil
+}
+
+// GetJob returns the current state of a job
+//
+// nil will be returned if the job doesn't exist anymore
+func (ds *DataStore) GetJob(id primitive.ObjectID) (*structs.Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	var job *structs.Job
+	err := ds.Db().Collection("jobs").FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		_ = glg.Errorf("could not retrieve job %s: %s", id.Hex(), err)
+		return nil, err
+	}
+	return job, nil
+}
+
+// GetInFlightJobs returns the jobs that are currently processed by any client
+func (ds *DataStore) GetInFlightJobs() ([]structs.Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	cursor, err := ds.Db().Collection("jobs").Find(ctx, bson.M{"Status": bson.M{"$in": inFlightStatuses}})
+	if err != nil {
+		_ = glg.Errorf("could not retrieve jobs in flight: %s", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	jobs := make([]structs.Job, 0)
+	if err := cursor.All(ctx, &jobs); err != nil {
+		_ = glg.Errorf("could not read jobs in flight: %s", err)
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// claimant identifies this process when claiming jobs
+func claimant() string {
+	return fmt.Sprintf("%s-%d", globalstate.Instance().HostName, os.Getpid())
+}
+
+// claimedByThisClient matches the claims of this client, including those of earlier processes
+func claimedByThisClient() primitive.Regex {
+	return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(globalstate.Instance().HostName) + "-[0-9]+$"}
+}
+
+// ClaimedByThisClient reports whether claimedBy is a claim of this client, made by this or an earlier process
+func ClaimedByThisClient(claimedBy string) bool {
+	matched, _ := regexp.MatchString(claimedByThisClient().Pattern, claimedBy)
+	return matched
+}
+
+// ModifyJob inserts or updates a job for the given client
+//
+// Jobs for primitive.NilObjectID are not pinned to any client and are placed in the shared pool.
+// Jobs that are being processed can't be updated
 func (ds *DataStore) ModifyJob(job *structs.Job, clientID primitive.ObjectID, mode string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
@@ -91,20 +347,39 @@ func (ds *DataStore) ModifyJob(job *structs.Job, clientID primitive.ObjectID, mo
 	switch mode {
 	case consts.INSERT:
 		job.ID = primitive.NewObjectID()
-		job.AssignedClient = structs.DBRef{
-			Ref: "clients",
-			ID:  clientID,
-			DB:  "undefined",
-		}
+		job.AssignedClient = clientRef(clientID)
 		job.AssignedClientLoaded = nil
+		job.Status = consts.JOB_STATUS_QUEUED
+		job.EnqueuedAt = time.Now()
+		job.ClaimedBy = ""
+		job.LeaseExpiry = time.Time{}
 		_, err = jobColl.InsertOne(ctx, job)
 	case consts.UPDATE:
-		job.AssignedClient = structs.DBRef{
-			Ref: "clients",
-			ID:  clientID,
-			DB:  "undefined",
+		job.AssignedClient = clientRef(clientID)
+		// only the fields a user may edit are updated, queue and claim state stay untouched
+		set := bson.M{
+			"Path":             job.Path,
+			"Name":             job.Name,
+			"Subtitle":         job.Subtitle,
+			"CustomParameters": job.CustomParameters,
+			"AssignedClient":   job.AssignedClient,
+		}
+		// jobs that are assigned manually are no longer pool jobs
+		unset := bson.M{"Pooled": ""}
+		for field, value := range map[string]time.Time{"NotBefore": job.NotBefore, "Deadline": job.Deadline} {
+			if value.IsZero() {
+				unset[field] = ""
+			} else {
+				set[field] = value
+			}
+		}
+		var res *mongo.UpdateResult
+		res, err = jobColl.UpdateOne(ctx,
+			bson.M{"_id": job.ID, "Status": bson.M{"$nin": inFlightStatuses}},
+			bson.M{"$set": set, "$unset": unset})
+		if err == nil && res.MatchedCount == 0 {
+			err = fmt.Errorf("job %s doesn't exist or is being processed", job.ID.Hex())
 		}
-		_, err = jobColl.ReplaceOne(ctx, bson.M{"_id": job.ID}, job)
 	}
 	if err != nil {
 		_ = glg.Errorf("could not %s job %s: %s", mode, job.Name, err)
@@ -114,6 +389,79 @@ func (ds *DataStore) ModifyJob(job *structs.Job, clientID primitive.ObjectID, mo
 	return nil
 }
 
+// BumpJob moves a job to the front of the queue by raising its priority above all other queued jobs
+func (ds *DataStore) BumpJob(jobId string) (*structs.Job, error) {
+	return ds.reorderJob(jobId, true)
+}
+
+// SinkJob moves a job to the back of the queue by lowering its priority below all other queued jobs
+func (ds *DataStore) SinkJob(jobId string) (*structs.Job, error) {
+	return ds.reorderJob(jobId, false)
+}
+
+func (ds *DataStore) reorderJob(jobId string, toFront bool) (*structs.Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	jobPOID, err := primitive.ObjectIDFromHex(jobId)
+	if err != nil {
+		return nil, err
+	}
+	jobColl := ds.Db().Collection("jobs")
+	priority, err := ds.edgePriority(ctx, jobPOID, toFront)
+	if err != nil {
+		_ = glg.Errorf("could not determine queue bounds for job %s: %s", jobId, err)
+		return nil, err
+	}
+
+	var result *structs.Job
+	err = jobColl.FindOneAndUpdate(ctx, bson.M{"_id": jobPOID}, bson.M{"$set": bson.M{"Priority": priority}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&result)
+	if err != nil {
+		_ = glg.Errorf("could not reorder job %s: %s", jobId, err)
+		return nil, err
+	}
+	_ = glg.Infof("moved job %s to priority %d", result.Name, priority)
+	return result, nil
+}
+
+// edgePriority returns a priority above or below those of all jobs other than jobID
+func (ds *DataStore) edgePriority(ctx context.Context, jobID primitive.ObjectID, toFront bool) (int32, error) {
+	direction := -1
+	if !toFront {
+		direction = 1
+	}
+	var edge *structs.Job
+	err := ds.Db().Collection("jobs").FindOne(ctx, bson.M{"_id": bson.M{"$ne": jobID}},
+		options.FindOne().SetSort(bson.D{{Key: "Priority", Value: direction}})).Decode(&edge)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return 0, err
+	}
+	var priority int32
+	if edge != nil {
+		priority = edge.Priority - int32(direction)
+	}
+	return priority, nil
+}
+
+// DeleteClaimedJob deletes a finished job as long as it is still claimed by this process
+//
+// A job whose lease expired may have been requeued and claimed by another client, it is left alone
+func (ds *DataStore) DeleteClaimedJob(job *structs.Job) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	res, err := ds.Db().Collection("jobs").DeleteOne(ctx, bson.M{"_id": job.ID, "ClaimedBy": claimant()})
+	if err != nil {
+		_ = glg.Errorf("could not delete job %s: %s", job.Name, err)
+		return 0, err
+	}
+	if res.DeletedCount == 0 {
+		_ = glg.Warnf("job %s is not claimed by %s anymore, not deleting it", job.Name, claimant())
+	} else {
+		_ = glg.Infof("deleted job %s", job.Name)
+	}
+	return res.DeletedCount, nil
+}
+
 func (ds *DataStore) DeleteJob(jobId string) (int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
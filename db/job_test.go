@@ -9,6 +9,7 @@ import (
 	"github.com/Spiritreader/avior-go/config"
 	"github.com/Spiritreader/avior-go/consts"
 	"github.com/Spiritreader/avior-go/structs"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -305,3 +306,44 @@ func TestDataStore_Job(t *testing.T) {
 		})
 	}
 }
+
+// Tests that a job requeued with RequeueJobLast is claimed after the other queued jobs
+func TestDataStore_RequeueJobLast(t *testing.T) {
+	_ = config.LoadLocalFrom("../config.json")
+	aviorDb, errConnect := Connect()
+	defer func() {
+		if errConnect == nil {
+			if err := aviorDb.Client().Disconnect(context.TODO()); err != nil {
+				fmt.Printf("error disconnecting cient, %s", err)
+			}
+		}
+	}()
+	if errConnect != nil {
+		fmt.Printf("error connecting to database, %s", errConnect)
+		return
+	}
+	ds := Get()
+	clientID := primitive.NewObjectID()
+	defer func() {
+		_, _ = ds.Db().Collection("jobs").DeleteMany(context.TODO(), bson.M{"AssignedClient.$id": clientID})
+	}()
+	for _, name := range []string{"first", "second"} {
+		job := &structs.Job{Path: name + ".ts", Name: name}
+		if err := ds.ModifyJob(job, clientID, consts.INSERT); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filter := func() bson.M { return claimableFilter(bson.M{"AssignedClient.$id": clientID}) }
+
+	job, err := ds.claimJob(filter(), nil)
+	if err != nil || job == nil || job.Name != "first" {
+		t.Fatalf("expected to claim the first job, got %v, %v", job, err)
+	}
+	if err := ds.RequeueJobLast(job); err != nil {
+		t.Fatal(err)
+	}
+	job, err = ds.claimJob(filter(), nil)
+	if err != nil || job == nil || job.Name != "second" {
+		t.Errorf("expected the cancelled job to be claimed last, got %v, %v", job, err)
+	}
+}
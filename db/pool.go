@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/Spiritreader/avior-go/structs"
+	"github.com/Spiritreader/avior-go/tools"
+	"github.com/kpango/glg"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PoolGrace is the time after which a pool job may be claimed by any eligible client,
+// regardless of whether clients with a better priority are idle
+var PoolGrace = 10 * time.Minute
+
+// clientRef returns the database reference for a client, primitive.NilObjectID refers to the shared pool
+func clientRef(clientID primitive.ObjectID) structs.DBRef {
+	if clientID.IsZero() {
+		return poolRef()
+	}
+	return structs.DBRef{
+		Ref: "clients",
+		ID:  clientID,
+		DB:  "undefined",
+	}
+}
+
+// poolRef returns the reference of jobs that are not assigned to a client
+func poolRef() structs.DBRef {
+	return structs.DBRef{
+		Ref: "clients",
+		ID:  nil,
+		DB:  "undefined",
+	}
+}
+
+// claimPoolJob claims the next unassigned job for the client
+//
+// The claimed job is assigned to the client while it is being processed and returned to the pool if its lease expires.
+// Clients are only eligible while they are online and inside their availability window,
+// as long as they process fewer than MaximumJobs jobs. Clients with a better (lower) priority are served first.
+//
+// nil will be returned if there is no job the client may take
+func (ds *DataStore) claimPoolJob(client *structs.Client) (*structs.Job, error) {
+	now := time.Now()
+	if !clientEligible(*client, now) {
+		return nil, nil
+	}
+	active, err := ds.activeJobCount(client.ID)
+	if err != nil {
+		return nil, err
+	}
+	if client.MaximumJobs > 0 && active >= int64(client.MaximumJobs) {
+		_ = glg.Logf("client %s holds %d/%d jobs, not pulling from pool", client.Name, active, client.MaximumJobs)
+		return nil, nil
+	}
+
+	filter := claimableFilter(bson.M{"AssignedClient.$id": nil})
+	turn, err := ds.poolTurn(client, filter, now)
+	if err != nil {
+		return nil, err
+	}
+	if !turn {
+		// leave fresh jobs to clients with a better priority, only take jobs that have been waiting too long
+		filter["EnqueuedAt"] = bson.M{"$lte": now.Add(-PoolGrace)}
+	}
+	result, err := ds.claimJob(filter, bson.M{"AssignedClient": clientRef(client.ID), "Pooled": true})
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		_ = glg.Infof("pulled job %s from pool for client %s", result.Name, client.Name)
+	}
+	return result, nil
+}
+
+// poolTurn reports whether there are more claimable pool jobs than idle eligible clients with a better priority
+func (ds *DataStore) poolTurn(client *structs.Client, filter bson.M, now time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	pending, err := ds.Db().Collection("jobs").CountDocuments(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	if pending == 0 {
+		return false, nil
+	}
+	clients, err := ds.GetClients()
+	if err != nil {
+		return false, err
+	}
+	var ahead int64
+	for _, other := range clients {
+		if other.ID == client.ID || other.Priority >= client.Priority || !clientEligible(other, now) {
+			continue
+		}
+		active, err := ds.activeJobCount(other.ID)
+		if err != nil {
+			return false, err
+		}
+		if active == 0 {
+			ahead++
+		}
+	}
+	return pending > ahead, nil
+}
+
+// activeJobCount returns the number of jobs a client is processing, queued jobs pinned to it don't count
+func (ds *DataStore) activeJobCount(clientID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	return ds.Db().Collection("jobs").CountDocuments(ctx, bson.M{
+		"AssignedClient.$id": clientID,
+		"Status":             bson.M{"$in": inFlightStatuses},
+	})
+}
+
+// clientEligible reports whether a client may pull jobs from the pool at the given time
+func clientEligible(client structs.Client, now time.Time) bool {
+	return (client.Online || client.IgnoreOnline) &&
+		tools.InTimeSpan(client.AvailabilityStart, client.AvailabilityEnd, now)
+}
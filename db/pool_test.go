@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/consts"
+	"github.com/Spiritreader/avior-go/structs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Tests that queued jobs pinned to a client don't count as active, only claimed jobs do
+func TestDataStore_ActiveJobCount(t *testing.T) {
+	_ = config.LoadLocalFrom("../config.json")
+	aviorDb, errConnect := Connect()
+	defer func() {
+		if errConnect == nil {
+			if err := aviorDb.Client().Disconnect(context.TODO()); err != nil {
+				fmt.Printf("error disconnecting cient, %s", err)
+			}
+		}
+	}()
+	if errConnect != nil {
+		fmt.Printf("error connecting to database, %s", errConnect)
+		return
+	}
+	ds := Get()
+	clientID := primitive.NewObjectID()
+	defer func() {
+		_, _ = ds.Db().Collection("jobs").DeleteMany(context.TODO(), bson.M{"AssignedClient.$id": clientID})
+	}()
+	for idx := 0; idx < 3; idx++ {
+		job := &structs.Job{Path: fmt.Sprintf("pinned %d.ts", idx), Name: fmt.Sprintf("pinned %d", idx)}
+		if err := ds.ModifyJob(job, clientID, consts.INSERT); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	active, err := ds.activeJobCount(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active != 0 {
+		t.Errorf("queued pinned jobs counted as active: %d", active)
+	}
+
+	job, err := ds.claimJob(claimableFilter(bson.M{"AssignedClient.$id": clientID}), nil)
+	if err != nil || job == nil {
+		t.Fatalf("could not claim pinned job: %v", err)
+	}
+	active, err = ds.activeJobCount(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active != 1 {
+		t.Errorf("expected the claimed job to be active, got %d", active)
+	}
+}
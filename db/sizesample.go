@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/Spiritreader/avior-go/structs"
+	"github.com/kpango/glg"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// InsertSizeSample stores the size of a finished encode
+func (ds *DataStore) InsertSizeSample(sample *structs.SizeSample) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	sample.ID = primitive.NewObjectID()
+	_, err := ds.Db().Collection("size_samples").InsertOne(ctx, sample)
+	if err != nil {
+		_ = glg.Errorf("could not insert size sample for %s/%s: %s", sample.Tag, sample.Profile, err)
+		return err
+	}
+	return nil
+}
+
+// GetSizeSamples retrieves the newest size samples of a resolution tag and encoder profile
+//
+// limit <= 0 returns all samples
+func (ds *DataStore) GetSizeSamples(tag string, profile string, limit int64) ([]structs.SizeSample, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "Recorded", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	sampleCursor, err := ds.Db().Collection("size_samples").Find(ctx, bson.M{"Tag": tag, "Profile": profile}, opts)
+	if err != nil {
+		_ = glg.Errorf("could not retrieve size samples: %s", err)
+		return nil, err
+	}
+	defer sampleCursor.Close(ctx)
+	samples := make([]structs.SizeSample, 0)
+	err = sampleCursor.All(ctx, &samples)
+	if err != nil {
+		_ = glg.Errorf("could not read size samples: %s", err)
+		return nil, err
+	}
+	return samples, nil
+}
@@ -0,0 +1,78 @@
+package encoder
+
+import (
+	"sync"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/globalstate"
+	"github.com/Spiritreader/avior-go/tools"
+)
+
+// Encoder is a backend that performs the encodes started by Encode
+type Encoder interface {
+	// Name identifies the backend in logs
+	Name() string
+	// Call returns a printable representation of the encoder call for req
+	Call(req Request) string
+	// Run encodes req.Input to req.OutPath and reports its progress to the global state.
+	//
+	// It returns the exit code of the encode and whether it failed because the output already exists.
+	// err is only set if the encode could not be started
+	Run(req Request) (exitCode int, fileExists bool, err error)
+	// Verify checks whether an encoded file is valid
+	Verify(path string) (bool, error)
+	// Probe reads the duration and streams of a file
+	Probe(path string) (tools.ProbeInfo, error)
+	// Compare measures the quality of a segment of the encoded output against the source.
+	// The segment starts at start in the output and at start + sourceOffset in the source
+	Compare(source string, output string, start int, length int, sourceOffset int) (Quality, error)
+	// Detect finds black and silent intervals in a segment of a file, the intervals are in seconds from the start of the file
+	Detect(path string, start int, length int, settings config.Trimming) (black []Interval, silence []Interval, err error)
+	// Stop aborts all running encodes
+	Stop()
+}
+
+// Interval is a time span in seconds
+type Interval struct {
+	Start float64
+	End   float64
+}
+
+// Request holds everything a backend needs to know to perform an encode
+type Request struct {
+	Input         string
+	PreArguments  []string
+	PostArguments []string
+	// Start is the position in seconds the encode starts at, 0 to start at the beginning
+	Start int
+	// Duration is the length in seconds that will be encoded, 0 to encode everything
+	Duration  int
+	Overwrite bool
+	OutPath   string
+	// FixedDuration is set if the total duration in the global state has been set by the caller
+	// and must not be replaced by the duration of the input
+	FixedDuration bool
+	// Metadata is the path of an ffmetadata file with chapters and tags for the output, empty if there is none
+	Metadata string
+	// Slice receives the progress of slice encodes instead of the encoder state if it is set
+	Slice *globalstate.SliceProgress
+}
+
+var (
+	backend      Encoder = &FFmpeg{}
+	backendMutex sync.RWMutex
+)
+
+// Backend returns the encoder backend that is currently in use
+func Backend() Encoder {
+	backendMutex.RLock()
+	defer backendMutex.RUnlock()
+	return backend
+}
+
+// SetBackend replaces the encoder backend, the default is ffmpeg
+func SetBackend(e Encoder) {
+	backendMutex.Lock()
+	defer backendMutex.Unlock()
+	backend = e
+}
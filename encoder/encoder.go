@@ -1,16 +1,13 @@
 package encoder
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
-	"io"
+	"math"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/Spiritreader/avior-go/config"
@@ -20,7 +17,6 @@ import (
 	"github.com/Spiritreader/avior-go/tools"
 	"github.com/kpango/glg"
 	"github.com/rs/xid"
-	"golang.org/x/sys/windows"
 )
 
 type Stats struct {
@@ -30,127 +26,238 @@ type Stats struct {
 	// Encoded output path including file name
 	OutputPath string
 	Call       string
+	// Profile is the name of the encoder profile that was used
+	Profile string
+	// Quality is set if the quality gate has been run
+	Quality *Quality
+	// Trim is set if the padding of the recording has been cut
+	Trim *Trim
 }
 
 var ErrNoTag = errors.New("no tag found")
+var ErrCancelled = errors.New("encode cancelled")
+var ErrNoProfile = errors.New("no such encoder profile")
+var ErrNoLength = errors.New("recorded length unknown")
+
+var cancelled atomic.Bool
 
 var state *globalstate.Data = globalstate.Instance()
 
 func Encode(file media.File, start, duration int, overwrite bool, dstDir *string) (Stats, error) {
-	state.Encoder.Active = true
-	state.Encoder.LineOut = make([]string, 0)
-	defer func() {
-		state.Encoder.Active = false
-	}()
-	cfg := config.Instance()
-	encoderConfig, ok := cfg.Local.EncoderConfig[file.Resolution.Tag]
-	if !ok {
-		_ = glg.Errorf("no encoder config found for tag %s, file %s", file.Resolution.Tag, file.Path)
-		return Stats{false, -1, -1337, "", ""}, ErrNoTag
-	}
-	_ = glg.Infof("tag/resolution %s:%s", file.Resolution.Tag, file.Resolution.Value)
+	return EncodeWithProfile(file, 0, start, duration, overwrite, dstDir)
+}
 
-	// use custom parameters instead of encoder config if provided
-	if len(file.CustomParams) > 0 {
-		customPreArgs := make([]string, 0)
-		customPostArgs := make([]string, 0)
-		for _, cParam := range file.CustomParams {
-			if strings.HasPrefix(cParam, consts.COMPAT_CPARAM_PREFIX) {
-				split := strings.Split(cParam, consts.COMPAT_CPARAM_PREFIX)
-				customPreArgs = append(customPreArgs, split[1])
-			} else {
-				customPostArgs = append(customPostArgs, cParam)
-			}
-		}
-		encoderConfig.PreArguments = customPreArgs
-		encoderConfig.PostArguments = customPostArgs
+// EncodeWithProfile encodes the file using the encoder profile at the given index of Profiles
+func EncodeWithProfile(file media.File, profileIdx int, start, duration int, overwrite bool, dstDir *string) (Stats, error) {
+	return encode(file, profileIdx, start, duration, overwrite, dstDir, nil)
+}
 
-		// channel configuration will always have to be manually set if using custom parameters for now
-		encoderConfig.MultiChArguments = make([]string, 0)
-		encoderConfig.StereoArguments = make([]string, 0)
-	}
+// EncodeSlice encodes a slice of the file for size estimations next to the source.
+//
+// Its progress is reported to slice instead of the encoder state, so multiple slices can be encoded at the same time
+func EncodeSlice(file media.File, start, duration int, slice *globalstate.SliceProgress) (Stats, error) {
+	return encode(file, 0, start, duration, true, nil, slice)
+}
 
-	// allow overwrite setting
-	params := make([]string, 0)
-	if overwrite {
-		params = append(params, "-y")
-	} else {
-		params = append(params, "-n")
+func encode(file media.File, profileIdx int, start, duration int, overwrite bool, dstDir *string,
+	slice *globalstate.SliceProgress) (Stats, error) {
+	if slice == nil {
+		state.Encoder.Active = true
+		state.Encoder.LineOut = make([]string, 0)
+		defer func() {
+			state.Encoder.Active = false
+		}()
 	}
+	if cancelled.Load() {
+		return Stats{false, -1, -1337, "", "", "", nil, nil}, ErrCancelled
+	}
+	profiles, err := Profiles(file)
+	if err != nil {
+		_ = glg.Errorf("no encoder config found for tag %s, file %s", file.Resolution.Tag, file.Path)
+		return Stats{false, -1, -1337, "", "", "", nil, nil}, err
+	}
+	if profileIdx < 0 || profileIdx >= len(profiles) {
+		return Stats{false, -1, -1337, "", "", "", nil, nil}, ErrNoProfile
+	}
+	profile := profiles[profileIdx]
+	_ = glg.Infof("tag/resolution %s:%s, profile %s", file.Resolution.Tag, file.Resolution.Value, profile.Name)
 
-	// pre arguments for ffmpeg
-	for _, preArgument := range encoderConfig.PreArguments {
+	// pre arguments for the encoder
+	preArgs := make([]string, 0)
+	for _, preArgument := range profile.PreArguments {
 		if len(preArgument) == 0 {
 			continue
 		}
 		split := strings.Split(preArgument, " ")
-		params = append(params, split...)
-	}
-
-	if start > 0 {
-		params = append(params, "-ss", strconv.Itoa(start))
-	}
-	params = append(params, "-i", file.Path)
-	if duration > 0 {
-		params = append(params, "-t", strconv.Itoa(duration))
+		preArgs = append(preArgs, split...)
 	}
 
-	// post arguments for ffmpeg
-	for _, postArgument := range encoderConfig.PostArguments {
+	// post arguments for the encoder
+	postArgs := make([]string, 0)
+	for _, postArgument := range profile.PostArguments {
 		if len(postArgument) == 0 {
 			continue
 		}
 		split := strings.Split(postArgument, " ")
-		params = append(params, split...)
+		postArgs = append(postArgs, split...)
 	}
 
-	// channel arguments for ffmpeg
+	// channel arguments for the encoder
 	// if the audio format can be assumed or is assuredly stereo,
 	// we will allow for the stereo profile to be applied
 	// otherwise apply multi channel arguments.
 	// If the arguments are empty encoding will happen,
 	// but without user-defined audio cfg
 	if file.AudioFormat <= media.STEREO_MAYBE {
-		if len(encoderConfig.StereoArguments) > 0 {
+		if len(profile.StereoArguments) > 0 {
 			glg.Infof("using stereo audio encoding profile")
 		}
-		for _, channelArgument := range encoderConfig.StereoArguments {
+		for _, channelArgument := range profile.StereoArguments {
 			if len(channelArgument) == 0 {
 				continue
 			}
 			split := strings.Split(channelArgument, " ")
-			params = append(params, split...)
+			postArgs = append(postArgs, split...)
 		}
 	} else {
-		if len(encoderConfig.MultiChArguments) > 0 {
+		if len(profile.MultiChArguments) > 0 {
 			glg.Infof("using multi channel audio encoding profile")
 		}
-		for _, channelArgument := range encoderConfig.MultiChArguments {
+		for _, channelArgument := range profile.MultiChArguments {
 			if len(channelArgument) == 0 {
 				continue
 			}
 			split := strings.Split(channelArgument, " ")
-			params = append(params, split...)
+			postArgs = append(postArgs, split...)
+		}
+	}
+
+	// stream selection, custom parameters have to map streams themselves
+	var selectedStreams []tools.ProbeStream
+	policy := config.Instance().Local.EncoderConfig[file.Resolution.Tag].StreamPolicy
+	if policy.Enabled && len(file.CustomParams) == 0 {
+		if info, err := Backend().Probe(file.Path); err != nil {
+			_ = glg.Warnf("could not probe streams, using default stream selection: %s", err)
+		} else {
+			selectedStreams = selectStreams(info, policy)
+			mapArgs := mapArguments(selectedStreams)
+			_ = glg.Infof("stream mapping: %s", strings.Join(mapArgs, " "))
+			postArgs = append(postArgs, mapArgs...)
+		}
+	}
+
+	// trim the padding of full encodes
+	backend := Backend()
+	encStart, encDuration := start, duration
+	var trim *Trim
+	if settings := config.Instance().Local.Trimming; settings.Enabled && start == 0 && duration == 0 {
+		total := sourceDuration(backend, file)
+		if trim, err = findTrim(backend, file, total, settings); err != nil {
+			_ = glg.Warnf("could not detect cut points, encoding without trimming: %s", err)
+		} else if trim != nil {
+			encStart = int(math.Floor(trim.Start))
+			encDuration = int(math.Ceil(trim.End)) - encStart
+			trim = &Trim{float64(encStart), float64(encStart + encDuration)}
+			_ = glg.Infof("trimming recording to %s", trim)
+		}
+		if cancelled.Load() {
+			return Stats{false, -1, -1337, "", "", profile.Name, nil, trim}, ErrCancelled
 		}
 	}
 
+	// chapters and tags for full encodes
+	var metadataPath string
+	settings := config.Instance().Local.Metadata
+	if settings.AviorTags && start == 0 && duration == 0 {
+		postArgs = append(postArgs, aviorTags(file, profile.Name)...)
+	}
+	if (settings.Chapters || settings.EpgTags) && start == 0 && duration == 0 {
+		metadataPath, err = writeMetadata(file, sourceDuration(backend, file), trim, settings)
+		if err != nil {
+			_ = glg.Warnf("could not write metadata file, encoding without chapters and tags: %s", err)
+		} else if len(metadataPath) > 0 {
+			defer os.Remove(metadataPath)
+		}
+	}
+
+	// slices and estimates use the bitrate of the full encode, they only cover a part of it
+	length := file.RecordedLength * 60
+	if trim != nil {
+		length = encDuration
+	} else if start > 0 || duration > 0 {
+		length = programmeLength(file)
+	}
+
+	// two-pass encodes with an average video bitrate
+	bitrate, err := targetBitrate(profile, length)
+	if err != nil {
+		_ = glg.Errorf("could not determine target bitrate for profile %s, file %s: %s", profile.Name, file.Path, err)
+		return Stats{false, -1, -1337, "", "", profile.Name, nil, trim}, err
+	}
+	passes := 1
+	if bitrate > 0 {
+		_ = glg.Infof("using two-pass encode with an average video bitrate of %dk", bitrate)
+		postArgs = append(postArgs, "-b:v", fmt.Sprintf("%dk", bitrate))
+		passes = 2
+	}
+	if slice == nil {
+		state.Encoder.Pass = 0
+		state.Encoder.OfPasses = passes
+	}
+
 	// determine which output path to use
 	customDuration := false
 	var outPath string
-	if duration > 0 && start > 0 {
+	if slice != nil || duration > 0 && start > 0 {
 		outPath = filepath.Join(filepath.Dir(file.Path), fmt.Sprintf("%s.estimate.mkv", xid.New()))
-		durationTime := new(time.Time).Add(time.Duration(duration)*time.Second).AddDate(-1, 0, 0)
-		state.Encoder.Duration = durationTime
+		if slice == nil {
+			durationTime := new(time.Time).Add(time.Duration(duration)*time.Second).AddDate(-1, 0, 0)
+			state.Encoder.Duration = durationTime
+		}
 		customDuration = true
 		_ = glg.Infof("output file path: %s", outPath)
-	} else if dstDir != nil {
-		outPath = filepath.Join(*dstDir, file.OutName()+cfg.Local.Ext)
-		_ = glg.Infof("output file path: %s", outPath)
 	} else {
-		outPath = filepath.Join(encoderConfig.OutDirectory, file.OutName()+cfg.Local.Ext)
+		outPath, _ = OutputPath(file, dstDir)
 		_ = glg.Infof("output file path: %s", outPath)
 	}
-	state.Encoder.OutPath = outPath
+	if slice == nil {
+		state.Encoder.OutPath = outPath
+	}
+	if trim != nil {
+		state.Encoder.Duration = new(time.Time).Add(time.Duration(encDuration)*time.Second).AddDate(-1, 0, 0)
+		customDuration = true
+	}
+
+	req := Request{
+		Input:         file.Path,
+		PreArguments:  preArgs,
+		PostArguments: postArgs,
+		Start:         encStart,
+		Duration:      encDuration,
+		Overwrite:     overwrite,
+		OutPath:       outPath,
+		FixedDuration: customDuration,
+		Metadata:      metadataPath,
+		Slice:         slice,
+	}
+	passLog := filepath.Join(os.TempDir(), fmt.Sprintf("avior-%s.passlog", xid.New()))
+	passReqs := []Request{req}
+	if passes == 2 {
+		firstPass := req
+		firstPass.PostArguments = append(append([]string{}, postArgs...), "-pass", "1", "-passlogfile", passLog, "-an", "-f", "null")
+		firstPass.Overwrite = true
+		firstPass.OutPath = os.DevNull
+		firstPass.Metadata = ""
+		secondPass := req
+		secondPass.PostArguments = append(append([]string{}, postArgs...), "-pass", "2", "-passlogfile", passLog)
+		passReqs = []Request{firstPass, secondPass}
+		defer removePassLogs(passLog)
+	}
+	calls := make([]string, len(passReqs))
+	for idx := range passReqs {
+		calls[idx] = backend.Call(passReqs[idx])
+	}
+	call := strings.Join(calls, " && ")
 
 	exists := false
 	if _, err := os.Stat(outPath); !os.IsNotExist(err) {
@@ -158,51 +265,38 @@ func Encode(file media.File, start, duration int, overwrite bool, dstDir *string
 	}
 	if exists && !overwrite {
 		_ = glg.Infof("file already exists, skipping encoding")
-		return Stats{false, -1, 107, outPath, strings.Join(params, " ")}, errors.New("os reports that file exists, overwrite forbidden")
+		return Stats{false, -1, 107, outPath, call, profile.Name, nil, trim}, errors.New("os reports that file exists, overwrite forbidden")
 	}
 
-	// call ffmpeg
-	params = append(params, outPath)
 	startTime := time.Now()
-	cmd := exec.Command("ffmpeg", params...)
-	stderr, _ := cmd.StderrPipe()
-	stdout, _ := cmd.StdoutPipe()
-	multiReader := io.MultiReader(stderr, stdout)
-	if err := cmd.Start(); err != nil {
-		_ = glg.Errorf("could not start ffmpeg: %s", err)
-		return Stats{false, -1, -1337, "", ""}, err
-	}
-
-	hProcess, err := windows.OpenProcess(0x0400|0x0200, false, uint32(cmd.Process.Pid))
-	if err != nil {
-		_ = glg.Warnf("could not get ffmpeg handle using pid %d, err: %s", cmd.Process.Pid, err)
-	}
-	err = windows.SetPriorityClass(hProcess, config.PriorityUint32(cfg.Local.EncoderPriority))
-	if err != nil {
-		_ = glg.Warnf("could not set priority %s for ffmpeg handle using pid %d, err: %s",
-			cfg.Local.EncoderConfig, cmd.Process.Pid, err)
-	}
-	err = windows.CloseHandle(hProcess)
-	if err != nil {
-		_ = glg.Errorf("could not close handle for pid %d, err: %s", cmd.Process.Pid, err)
-	}
-
-	// scan stdout
-	scanner := bufio.NewScanner(multiReader)
-	scanner.Split(ScanLinesSTDOUT)
-	fileExistsReturnCode := false
-	for scanner.Scan() {
-		if parseOut(scanner.Text(), customDuration) {
-			fileExistsReturnCode = true
+	var exitCode int
+	var fileExistsReturnCode bool
+	for idx, passReq := range passReqs {
+		if slice == nil {
+			state.Encoder.Pass = idx + 1
+		}
+		if passes > 1 {
+			_ = glg.Infof("encoding pass %d/%d", idx+1, passes)
+		}
+		exitCode, fileExistsReturnCode, err = backend.Run(passReq)
+		if err != nil {
+			_ = glg.Errorf("could not start %s: %s", backend.Name(), err)
+			return Stats{false, -1, -1337, "", "", profile.Name, nil, trim}, err
+		}
+		if exitCode != 0 || cancelled.Load() {
+			break
 		}
 	}
-	if err := cmd.Wait(); err != nil {
-		_ = glg.Errorf("ffmpeg error: %s", err)
-	}
-	exitCode := cmd.ProcessState.ExitCode()
 	encTime := time.Since(startTime)
+	if cancelled.Load() {
+		_ = glg.Warnf("encode has been cancelled, removing partial output %s", outPath)
+		if err := os.Remove(outPath); err != nil && !os.IsNotExist(err) {
+			_ = glg.Errorf("could not remove partial output: %s", err)
+		}
+		return Stats{false, encTime, exitCode, outPath, call, profile.Name, nil, trim}, ErrCancelled
+	}
 	if exitCode != 0 && fileExistsReturnCode {
-		return Stats{false, encTime, 108, outPath, strings.Join(params, " ")}, errors.New("exit code file exists overwrite forbidden")
+		return Stats{false, encTime, 108, outPath, call, profile.Name, nil, trim}, errors.New("exit code file exists overwrite forbidden")
 	} else if exitCode != 0 {
 		if _, err := os.Stat(outPath); !os.IsNotExist(err) {
 			// remove failed files
@@ -215,13 +309,13 @@ func Encode(file media.File, start, duration int, overwrite bool, dstDir *string
 				outPath = newPath
 			}
 		}
-		return Stats{false, encTime, exitCode, outPath, strings.Join(params, " ")}, errors.New("exit code not ok")
+		return Stats{false, encTime, exitCode, outPath, call, profile.Name, nil, trim}, errors.New("exit code not ok")
 	}
 
 	// verify file size
-	ok, vErrify := tools.FfProbeVerfiy(outPath)
+	ok, vErrify := backend.Verify(outPath)
 	if vErrify != nil && !(errors.Is(vErrify, tools.NoStreamsError) || errors.Is(vErrify, tools.ZeroDurationError)) {
-		glg.Warnf("could not verify file, will be assumed good: %s", err)
+		glg.Warnf("could not verify file, will be assumed good: %s", vErrify)
 	} else if !ok {
 		glg.Warnf("file verification failed, renaming: %s", outPath)
 		timestampString := time.Now().Format("2006-01-02 150405")
@@ -231,133 +325,171 @@ func Encode(file media.File, start, duration int, overwrite bool, dstDir *string
 		} else {
 			outPath = newPath
 		}
-		return Stats{false, encTime, 106, outPath, strings.Join(params, " ")}, vErrify
+		return Stats{false, encTime, 106, outPath, call, profile.Name, nil, trim}, vErrify
 	}
 
-	return Stats{true, encTime, exitCode, outPath, strings.Join(params, " ")}, nil
-}
-
-func ScanLinesSTDOUT(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
-	}
-	if i := bytes.IndexByte(data, '\n'); i >= 0 {
-		// We have a full newline-terminated line.
-		return i + 1, data[0:i], nil
-	} else if i := bytes.IndexByte(data, '\r'); i >= 0 {
-		// We have a refresh that needs to be printed
-		return i + 1, data[0:i], nil
+	// compare full encodes with the source
+	if settings := config.Instance().Local.Verification; settings.Enabled && duration == 0 {
+		if err := verifyAgainstSource(backend, file, outPath, time.Duration(encDuration)*time.Second, selectedStreams, settings); errors.Is(err, ErrVerification) {
+			glg.Warnf("file verification against source failed (%s), renaming: %s", err, outPath)
+			timestampString := time.Now().Format("2006-01-02 150405")
+			newPath := filepath.Join(filepath.Dir(outPath), fmt.Sprintf("%s-verification-failed-%s.mkv", file.OutName(), timestampString))
+			if err := os.Rename(outPath, newPath); err != nil {
+				glg.Errorf("could not rename file: %s", err)
+			} else {
+				outPath = newPath
+			}
+			return Stats{false, encTime, 106, outPath, call, profile.Name, nil, trim}, err
+		} else if err != nil {
+			glg.Warnf("could not verify file against source, will be assumed good: %s", err)
+		}
 	}
-	// If we're at EOF, we have a final, non-terminated line. Return it.
-	if atEOF {
-		return len(data), data, nil
+
+	// quality gate for full encodes
+	if gate := config.Instance().Local.QualityGate; gate.Enabled && duration == 0 {
+		quality, err := measureQuality(backend, file, outPath, encStart, encDuration, gate)
+		if cancelled.Load() {
+			_ = glg.Warnf("encode has been cancelled during the quality gate, removing output %s", outPath)
+			if err := os.Remove(outPath); err != nil && !os.IsNotExist(err) {
+				_ = glg.Errorf("could not remove output: %s", err)
+			}
+			return Stats{false, encTime, exitCode, outPath, call, profile.Name, nil, trim}, ErrCancelled
+		} else if err != nil {
+			glg.Warnf("could not measure quality, will be assumed good: %s", err)
+		} else if !quality.passes(gate) {
+			glg.Warnf("quality gate failed with %s, renaming: %s", quality, outPath)
+			timestampString := time.Now().Format("2006-01-02 150405")
+			newPath := filepath.Join(filepath.Dir(outPath), fmt.Sprintf("%s-low-quality-%s.mkv", file.OutName(), timestampString))
+			if err := os.Rename(outPath, newPath); err != nil {
+				glg.Errorf("could not rename file: %s", err)
+			} else {
+				outPath = newPath
+			}
+			return Stats{false, encTime, 105, outPath, call, profile.Name, &quality, trim}, fmt.Errorf("%w: %s", ErrLowQuality, quality)
+		} else {
+			_ = glg.Infof("quality gate passed with %s", quality)
+			return Stats{true, encTime, exitCode, outPath, call, profile.Name, &quality, trim}, nil
+		}
 	}
-	// Request more data.
-	return 0, nil, nil
+
+	return Stats{true, encTime, exitCode, outPath, call, profile.Name, nil, trim}, nil
 }
 
-func parseOut(line string, customDuration bool) (fileExists bool) {
-	durationToken := "Duration:"
-	frameToken := "frame"
-	fpsToken := "fps"
-	qToken := "q"
-	sizeToken := "size"
-	timeToken := "time"
-	bitrateToken := "bitrate"
-	dupToken := "dup"
-	dropToken := "drop"
-	speedToken := "speed"
-	fileExistsToken := "already exists. Exiting."
-
-	state.Encoder.LineOut = append(state.Encoder.LineOut, line)
-	if !customDuration && strings.Contains(line, durationToken) {
-		//fmt.Println(line)
-		_ = glg.Log(line)
-		keyIdx := strings.Index(line, durationToken) + len(durationToken)
-		timeIdx := strings.Index(line, ".")
-		state.Encoder.Duration, _ = time.Parse("15:04:05", strings.Trim(line[keyIdx:timeIdx], " "))
-		// safe enough for now
-	} else if strings.Contains(line, frameToken) {
-		// ffmpeg out looks like this:
-		// frame=  272 fps=271 q=15.0 size=     512kB time=00:00:11.07 bitrate= 378.8kbits/s dup=0 drop=269 speed=  11x
-		separated := make([]string, 0)
-		splitEq := strings.Split(line, "=")
-		for idx := range splitEq {
-			splitWs := strings.Split(strings.Trim(splitEq[idx], " "), " ")
-			separated = append(separated, splitWs...)
-		}
-		statMap := make(map[string]string)
-		for idx := 0; idx < len(separated)-1; idx += 2 {
-			statMap[separated[idx]] = separated[idx+1]
-		}
+// Cancel stops the running encode and prevents further encodes until ResetCancel is called.
+func Cancel() {
+	cancelled.Store(true)
+	Backend().Stop()
+}
 
-		if val, ok := statMap[frameToken]; ok {
-			frameParse, _ := strconv.ParseInt(val, 10, 32)
-			state.Encoder.Frame = int(frameParse)
-		}
-		if val, ok := statMap[fpsToken]; ok {
-			state.Encoder.Fps, _ = strconv.ParseFloat(val, 64)
-		}
-		if val, ok := statMap[qToken]; ok {
-			state.Encoder.Q, _ = strconv.ParseFloat(val, 64)
-		}
-		if val, ok := statMap[sizeToken]; ok {
-			state.Encoder.Size = val
-		}
-		if val, ok := statMap[timeToken]; ok {
-			cutIdx := strings.Index(val, ".")
-			if cutIdx != -1 {
-				state.Encoder.Position, _ = time.Parse("15:04:05", val)
-			}
+// Cancelled reports whether a cancellation has been requested since the last call to ResetCancel
+func Cancelled() bool {
+	return cancelled.Load()
+}
+
+// ResetCancel allows encodes to run again after a cancellation
+func ResetCancel() {
+	cancelled.Store(false)
+}
+
+// targetBitrate returns the average video bitrate in kbit/s of a two-pass encode, 0 if the profile doesn't use one
+//
+// length is the encoded duration in seconds
+func targetBitrate(profile config.EncoderProfile, length int) (int, error) {
+	switch profile.Mode {
+	case "", consts.ENCODE_MODE_ARGUMENTS:
+		return 0, nil
+	case consts.ENCODE_MODE_BITRATE:
+		if profile.TargetBitrate <= 0 {
+			return 0, errors.New("target bitrate must be positive")
 		}
-		if val, ok := statMap[bitrateToken]; ok {
-			state.Encoder.Bitrate = val
+		return profile.TargetBitrate, nil
+	case consts.ENCODE_MODE_SIZE:
+		if profile.TargetSize <= 0 {
+			return 0, errors.New("target size must be positive")
 		}
-		if val, ok := statMap[dupToken]; ok {
-			dupParse, _ := strconv.ParseInt(val, 10, 32)
-			state.Encoder.Dup = int(dupParse)
+		if length <= 0 {
+			return 0, ErrNoLength
 		}
-		if val, ok := statMap[dropToken]; ok {
-			dropParse, _ := strconv.ParseInt(val, 10, 32)
-			state.Encoder.Drop = int(dropParse)
+		// MB to kbit divided by the length in seconds
+		bitrate := profile.TargetSize*8000/length - profile.AudioBitrate
+		if bitrate <= 0 {
+			return 0, fmt.Errorf("target size %d MB leaves no room for video after %dk audio", profile.TargetSize, profile.AudioBitrate)
 		}
-		if val, ok := statMap[speedToken]; ok {
-			cutIdx := strings.Index(val, "x")
-			if cutIdx != -1 {
-				state.Encoder.Speed, _ = strconv.ParseFloat(strings.Trim(val[:cutIdx], " "), 64)
-			}
+		return bitrate, nil
+	}
+	return 0, fmt.Errorf("unknown encoding mode %s", profile.Mode)
+}
+
+// programmeLength returns the length in seconds of a full encode,
+// the epg length approximates the trimmed length if trimming is enabled
+func programmeLength(file media.File) int {
+	if config.Instance().Local.Trimming.Enabled && file.Length > 0 && file.Length < file.RecordedLength {
+		return file.Length * 60
+	}
+	return file.RecordedLength * 60
+}
+
+// sourceDuration returns the duration of the source in seconds, falling back to the recorded length if it can't be probed
+func sourceDuration(backend Encoder, file media.File) float64 {
+	if info, err := backend.Probe(file.Path); err == nil && info.Duration > 0 {
+		return info.Duration.Seconds()
+	}
+	return float64(file.RecordedLength * 60)
+}
+
+// removePassLogs removes the stats files written by the first pass of a two-pass encode
+func removePassLogs(passLog string) {
+	matches, _ := filepath.Glob(passLog + "*")
+	for _, match := range matches {
+		if err := os.Remove(match); err != nil {
+			_ = glg.Warnf("could not remove pass log %s: %s", match, err)
 		}
+	}
+}
 
-		if state.Encoder.Speed > 0 {
-			// calculate ETA
-			//fmt.Printf("Duration: %s\n", state.Encoder.Duration)
-			//fmt.Printf("Position: %s\n", state.Encoder.Position)
-			diff := state.Encoder.Duration.Sub(state.Encoder.Position)
-			//fmt.Printf("Difference: %s\n", diff)
-			if speed := time.Duration(state.Encoder.Speed); speed > 0 {
-				diff /= speed
-			}
-			state.Encoder.Remaining = diff
+// Profiles returns the ordered encoder profiles that can be used to encode the file
+//
+// Custom parameters of the file replace all configured profiles
+func Profiles(file media.File) ([]config.EncoderProfile, error) {
+	cfg := config.Instance()
+	encoderConfig, ok := cfg.Local.EncoderConfig[file.Resolution.Tag]
+	if !ok {
+		return nil, ErrNoTag
+	}
+	if len(file.CustomParams) == 0 {
+		return encoderConfig.Profiles(), nil
+	}
+	// use custom parameters instead of encoder config if provided
+	custom := config.EncoderProfile{
+		Name:          "custom",
+		PreArguments:  make([]string, 0),
+		PostArguments: make([]string, 0),
+		// channel configuration will always have to be manually set if using custom parameters for now
+		StereoArguments:  make([]string, 0),
+		MultiChArguments: make([]string, 0),
+	}
+	for _, cParam := range file.CustomParams {
+		if strings.HasPrefix(cParam, consts.COMPAT_CPARAM_PREFIX) {
+			split := strings.Split(cParam, consts.COMPAT_CPARAM_PREFIX)
+			custom.PreArguments = append(custom.PreArguments, split[1])
+		} else {
+			custom.PostArguments = append(custom.PostArguments, cParam)
 		}
-		durationDuration := state.Encoder.Duration.Sub(new(time.Time).AddDate(-1, 0, 0)).Seconds()
-		positionDuration := state.Encoder.Position.Sub(new(time.Time).AddDate(-1, 0, 0)).Seconds()
-		state.Encoder.Progress = (positionDuration / durationDuration) * 100
-		termOut := ""
-		termOut += fmt.Sprintf("Duration: %s ", state.Encoder.Duration.Format("15:04:05"))
-		termOut += fmt.Sprintf("Frame: %d ", state.Encoder.Frame)
-		termOut += fmt.Sprintf("Fps: %.2f ", state.Encoder.Fps)
-		termOut += fmt.Sprintf("Q: %.0f ", state.Encoder.Q)
-		termOut += fmt.Sprintf("Size: %s ", state.Encoder.Size)
-		termOut += fmt.Sprintf("Position: %s ", state.Encoder.Position.Format("15:04:05"))
-		termOut += fmt.Sprintf("Bitrate: %s ", state.Encoder.Bitrate)
-		termOut += fmt.Sprintf("Dup: %d ", state.Encoder.Dup)
-		termOut += fmt.Sprintf("Drop: %d ", state.Encoder.Drop)
-		termOut += fmt.Sprintf("Speed: %.1f ", state.Encoder.Speed)
-		termOut += fmt.Sprintf("Remaining: %s", state.Encoder.Remaining)
-		_ = glg.Log(termOut)
-		//fmt.Printf("\r" + termOut)
-	} else if strings.Contains(line, fileExistsToken) {
-		return true
-	}
-	return false
+	}
+	return []config.EncoderProfile{custom}, nil
+}
+
+// OutputPath returns the path a full encode of file is written to
+//
+// If dstDir is nil, the output directory of the encoder config for the file's resolution tag is used
+func OutputPath(file media.File, dstDir *string) (string, error) {
+	cfg := config.Instance()
+	if dstDir != nil {
+		return filepath.Join(*dstDir, file.OutName()+cfg.Local.Ext), nil
+	}
+	encoderConfig, ok := cfg.Local.EncoderConfig[file.Resolution.Tag]
+	if !ok {
+		return "", ErrNoTag
+	}
+	return filepath.Join(encoderConfig.OutDirectory, file.OutName()+cfg.Local.Ext), nil
 }
@@ -1,10 +1,18 @@
 package encoder
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/consts"
+	"github.com/Spiritreader/avior-go/globalstate"
 	"github.com/Spiritreader/avior-go/media"
+	"github.com/Spiritreader/avior-go/tools"
 )
 
 func TestEncode(t *testing.T) {
@@ -14,3 +22,336 @@ func TestEncode(t *testing.T) {
 	dst := "D:\\Recording\\testencode"
 	Encode(testFile, 0, 0, false, &dst)
 }
+
+func TestEncodeFakeBackend(t *testing.T) {
+	fake := &Fake{BytesPerSecond: 1000, Size: 4096, Valid: true}
+	SetBackend(fake)
+	defer SetBackend(&FFmpeg{})
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.mkv")
+	if err := os.WriteFile(input, []byte("source"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Instance()
+	cfg.Local.EncoderConfig = map[string]config.EncoderConfig{"hd": {OutDirectory: dir}}
+	testFile := media.File{Path: input, Name: "output", Resolution: media.Resolution{Tag: "hd"}}
+
+	stats, err := Encode(testFile, 60, 30, false, nil)
+	if err != nil {
+		t.Fatalf("estimate encode failed: %s", err)
+	}
+	info, err := os.Stat(stats.OutputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 30000 {
+		t.Errorf("expected estimate of 30000 bytes, got %d", info.Size())
+	}
+
+	stats, err = Encode(testFile, 0, 0, false, nil)
+	if err != nil {
+		t.Fatalf("full encode failed: %s", err)
+	}
+	if info, err = os.Stat(stats.OutputPath); err != nil || info.Size() != 4096 {
+		t.Errorf("expected full encode of 4096 bytes at %s", stats.OutputPath)
+	}
+	if _, err = Encode(testFile, 0, 0, false, nil); err == nil {
+		t.Error("expected encode to fail because the output exists")
+	}
+	if calls := fake.Calls(); len(calls) != 2 || calls[0].Start != 60 || calls[0].Duration != 30 {
+		t.Errorf("unexpected backend calls: %+v", calls)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	cfg := config.Instance()
+	cfg.Local.EncoderConfig = map[string]config.EncoderConfig{"hd": {
+		EncoderProfile: config.EncoderProfile{Name: "nvenc", PostArguments: []string{"-c:v hevc_nvenc"}},
+		Fallbacks:      []config.EncoderProfile{{PostArguments: []string{"-c:v libx265"}}},
+	}}
+	profiles, err := Profiles(media.File{Resolution: media.Resolution{Tag: "hd"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 || profiles[0].Name != "nvenc" || profiles[1].Name != "fallback 1" {
+		t.Errorf("unexpected profiles: %+v", profiles)
+	}
+	profiles, _ = Profiles(media.File{Resolution: media.Resolution{Tag: "hd"}, CustomParams: []string{"-c:v copy"}})
+	if len(profiles) != 1 || profiles[0].Name != "custom" {
+		t.Errorf("custom parameters should replace all profiles: %+v", profiles)
+	}
+	if _, err := Profiles(media.File{Resolution: media.Resolution{Tag: "uhd"}}); err != ErrNoTag {
+		t.Errorf("expected ErrNoTag, got %v", err)
+	}
+}
+
+func TestEncodeTwoPass(t *testing.T) {
+	fake := &Fake{Size: 2048, Valid: true}
+	SetBackend(fake)
+	defer SetBackend(&FFmpeg{})
+
+	dir := t.TempDir()
+	cfg := config.Instance()
+	cfg.Local.EncoderConfig = map[string]config.EncoderConfig{"hd": {
+		OutDirectory:   dir,
+		EncoderProfile: config.EncoderProfile{Mode: consts.ENCODE_MODE_SIZE, TargetSize: 600, AudioBitrate: 128},
+	}}
+	// 600 MB over 10 minutes leave 8000k minus 128k audio
+	testFile := media.File{Path: filepath.Join(dir, "input.mkv"), Name: "output", RecordedLength: 10, Resolution: media.Resolution{Tag: "hd"}}
+
+	stats, err := Encode(testFile, 0, 0, false, nil)
+	if err != nil {
+		t.Fatalf("two-pass encode failed: %s", err)
+	}
+	calls := fake.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("expected two passes, got %d", len(calls))
+	}
+	if !strings.Contains(fake.Call(calls[0]), "-b:v 7872k -pass 1") || calls[0].OutPath != os.DevNull {
+		t.Errorf("unexpected first pass: %+v", calls[0])
+	}
+	if !strings.Contains(fake.Call(calls[1]), "-pass 2") || calls[1].OutPath != stats.OutputPath {
+		t.Errorf("unexpected second pass: %+v", calls[1])
+	}
+	if state.Encoder.Pass != 2 || state.Encoder.OfPasses != 2 {
+		t.Errorf("expected progress to report pass 2/2, got %d/%d", state.Encoder.Pass, state.Encoder.OfPasses)
+	}
+
+	testFile.RecordedLength = -1
+	if _, err := Encode(testFile, 0, 0, true, nil); err != ErrNoLength {
+		t.Errorf("expected ErrNoLength, got %v", err)
+	}
+}
+
+func TestSliceBitrate(t *testing.T) {
+	fake := &Fake{Size: 2048, Valid: true}
+	SetBackend(fake)
+	defer SetBackend(&FFmpeg{})
+
+	dir := t.TempDir()
+	cfg := config.Instance()
+	cfg.Local.EncoderConfig = map[string]config.EncoderConfig{"hd": {
+		OutDirectory:   dir,
+		EncoderProfile: config.EncoderProfile{Mode: consts.ENCODE_MODE_SIZE, TargetSize: 600, AudioBitrate: 128},
+	}}
+	testFile := media.File{Path: filepath.Join(dir, "input.mkv"), Name: "output", RecordedLength: 10, Resolution: media.Resolution{Tag: "hd"}}
+
+	if _, err := Encode(testFile, 0, 0, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EncodeSlice(testFile, 120, 30, &globalstate.SliceProgress{}); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.Calls()
+	if len(calls) != 4 {
+		t.Fatalf("expected two passes for each encode, got %d calls", len(calls))
+	}
+	// a 30 second slice has to be encoded with the bitrate of the whole recording
+	if !strings.Contains(fake.Call(calls[0]), "-b:v 7872k") || !strings.Contains(fake.Call(calls[2]), "-b:v 7872k") {
+		t.Errorf("slice bitrate differs from the full encode: %s, %s", fake.Call(calls[0]), fake.Call(calls[2]))
+	}
+}
+
+func TestEncodeQualityGate(t *testing.T) {
+	fake := &Fake{Size: 1024, Valid: true, Quality: Quality{SSIM: 0.91, PSNR: 38}}
+	SetBackend(fake)
+	defer SetBackend(&FFmpeg{})
+
+	dir := t.TempDir()
+	cfg := config.Instance()
+	cfg.Local.EncoderConfig = map[string]config.EncoderConfig{"hd": {OutDirectory: dir}}
+	cfg.Local.QualityGate = config.QualityGate{Enabled: true, Samples: 3, SampleLength: 10, MinSSIM: 0.95}
+	defer func() { cfg.Local.QualityGate.Enabled = false }()
+	testFile := media.File{Path: filepath.Join(dir, "input.mkv"), Name: "output", RecordedLength: 30, Resolution: media.Resolution{Tag: "hd"}}
+
+	stats, err := Encode(testFile, 0, 0, false, nil)
+	if !errors.Is(err, ErrLowQuality) {
+		t.Fatalf("expected ErrLowQuality, got %v", err)
+	}
+	if stats.Quality == nil || stats.Quality.SSIM != 0.91 {
+		t.Errorf("expected averaged quality scores, got %v", stats.Quality)
+	}
+	if !strings.Contains(stats.OutputPath, "-low-quality-") {
+		t.Errorf("expected low quality output to be renamed, got %s", stats.OutputPath)
+	}
+
+	fake.Quality.SSIM = 0.97
+	if stats, err = Encode(testFile, 0, 0, false, nil); err != nil || !stats.Success {
+		t.Errorf("expected quality gate to pass, got %v", err)
+	}
+
+	// a cancel during the quality gate must not finish the encode
+	SetBackend(&cancellingFake{fake})
+	defer ResetCancel()
+	stats, err = Encode(testFile, 0, 0, true, nil)
+	if !errors.Is(err, ErrCancelled) || stats.Success {
+		t.Errorf("expected ErrCancelled, got %v", err)
+	}
+	if _, err := os.Stat(stats.OutputPath); !os.IsNotExist(err) {
+		t.Errorf("expected the output of a cancelled encode to be removed")
+	}
+}
+
+// cancellingFake cancels the encode while it is compared with the source
+type cancellingFake struct {
+	*Fake
+}
+
+func (c *cancellingFake) Compare(source string, output string, start int, length int, sourceOffset int) (Quality, error) {
+	Cancel()
+	return Quality{}, ErrCancelled
+}
+
+func TestEncodeVerification(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.mkv")
+	source := tools.ProbeInfo{Duration: 30 * time.Minute, Streams: []tools.ProbeStream{
+		{Index: 0, CodecType: "video"}, {Index: 1, CodecType: "audio", Channels: 6}}}
+	output := source
+	fake := &Fake{Size: 1024, Valid: true, ProbeFunc: func(path string) (tools.ProbeInfo, error) {
+		if path == input {
+			return source, nil
+		}
+		return output, nil
+	}}
+	SetBackend(fake)
+	defer SetBackend(&FFmpeg{})
+
+	cfg := config.Instance()
+	cfg.Local.EncoderConfig = map[string]config.EncoderConfig{"hd": {OutDirectory: dir}}
+	cfg.Local.Verification = config.Verification{Enabled: true, DurationTolerance: 5, Channels: true}
+	testFile := media.File{Path: input, Name: "output", RecordedLength: 30, Resolution: media.Resolution{Tag: "hd"}}
+
+	if _, err := Encode(testFile, 0, 0, true, nil); err != nil {
+		t.Errorf("expected matching output to pass, got %s", err)
+	}
+	output.Duration = 12 * time.Minute
+	stats, err := Encode(testFile, 0, 0, true, nil)
+	if !errors.Is(err, ErrVerification) || stats.ExitCode != 106 {
+		t.Errorf("expected truncated output to fail verification, got %v", err)
+	}
+	output.Duration = source.Duration + 3*time.Second
+	output.Streams = []tools.ProbeStream{{Index: 0, CodecType: "video"}, {Index: 1, CodecType: "audio", Channels: 2}}
+	if _, err := Encode(testFile, 0, 0, true, nil); !errors.Is(err, ErrVerification) {
+		t.Errorf("expected downmixed output to fail verification, got %v", err)
+	}
+
+	// ffmpeg keeps one audio stream of a multi-audio recording by default
+	cfg.Local.Verification.Streams = true
+	source.Streams = append(source.Streams, tools.ProbeStream{Index: 2, CodecType: "audio", Channels: 2},
+		tools.ProbeStream{Index: 3, CodecType: "subtitle"})
+	output.Streams = []tools.ProbeStream{{Index: 0, CodecType: "video"}, {Index: 1, CodecType: "audio", Channels: 6}}
+	if _, err := Encode(testFile, 0, 0, true, nil); err != nil {
+		t.Errorf("expected output with the default streams to pass, got %s", err)
+	}
+}
+
+func TestStreamPolicy(t *testing.T) {
+	info := tools.ProbeInfo{Streams: []tools.ProbeStream{
+		{Index: 0, CodecType: "video", CodecName: "h264"},
+		{Index: 1, CodecType: "audio", Channels: 2, Language: "deu"},
+		{Index: 2, CodecType: "audio", Channels: 2, Language: "deu", VisualImpaired: true},
+		{Index: 3, CodecType: "audio", Channels: 6, Language: "eng"},
+		{Index: 4, CodecType: "subtitle", CodecName: "dvb_subtitle", Language: "deu"},
+		{Index: 5, CodecType: "subtitle", CodecName: "dvb_teletext", Language: "deu"},
+	}}
+	policy := config.StreamPolicy{Enabled: true, AudioLanguages: []string{"deu"}, KeepTeletext: true, DropAudioDescription: true}
+	got := strings.Join(mapArguments(selectStreams(info, policy)), " ")
+	if want := "-map 0:0 -map 0:1 -map 0:5 -c:s:0 srt"; got != want {
+		t.Errorf("mapArguments() = %s, want %s", got, want)
+	}
+
+	policy = config.StreamPolicy{Enabled: true, AudioLanguages: []string{"fra"}, KeepSubtitles: true}
+	got = strings.Join(mapArguments(selectStreams(info, policy)), " ")
+	if want := "-map 0:0 -map 0:1 -map 0:2 -map 0:3 -map 0:4 -c:s:0 copy"; got != want {
+		t.Errorf("mapArguments() = %s, want %s", got, want)
+	}
+}
+
+func TestEncodeTrim(t *testing.T) {
+	// 100 minute recording of a 90 minute programme starting after 4 minutes,
+	// a black frame without silence at 60s must not be used as cut point
+	fake := &Fake{Size: 1024, Valid: true,
+		Black:   []Interval{{59.5, 60.5}, {239.6, 240.4}, {5640, 5640.8}, {5700, 5702}},
+		Silence: []Interval{{239, 241}, {5639.5, 5641}},
+		ProbeFunc: func(path string) (tools.ProbeInfo, error) {
+			return tools.ProbeInfo{Duration: 100 * time.Minute}, nil
+		},
+	}
+	SetBackend(fake)
+	defer SetBackend(&FFmpeg{})
+
+	dir := t.TempDir()
+	cfg := config.Instance()
+	cfg.Local.EncoderConfig = map[string]config.EncoderConfig{"hd": {OutDirectory: dir}}
+	cfg.Local.Verification.Enabled = false
+	cfg.Local.Trimming = config.Trimming{Enabled: true, SearchWindow: 300, Tolerance: 180, MinBlack: 0.4, MinSilence: 0.3, SilenceNoise: "-50dB"}
+	defer func() { cfg.Local.Trimming.Enabled = false }()
+	testFile := media.File{Path: filepath.Join(dir, "input.mkv"), Name: "output", RecordedLength: 100, Length: 90, Resolution: media.Resolution{Tag: "hd"}}
+
+	stats, err := Encode(testFile, 0, 0, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Trim == nil || stats.Trim.Start != 240 || stats.Trim.End != 5641 {
+		t.Fatalf("unexpected trim %v", stats.Trim)
+	}
+	calls := fake.Calls()
+	if calls[len(calls)-1].Start != 240 || calls[len(calls)-1].Duration != 5401 {
+		t.Errorf("trim not applied to encode: %+v", calls[len(calls)-1])
+	}
+
+	// nothing to trim if the recording is as long as the programme
+	testFile.Length = 100
+	if stats, err = Encode(testFile, 0, 0, true, nil); err != nil || stats.Trim != nil {
+		t.Errorf("expected untrimmed encode, got %v, %v", stats.Trim, err)
+	}
+}
+
+func TestWriteMetadata(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.mkv")
+	marks := "0:04:00.00 start\n0:50:00.12\n1:34:00.00 end\n"
+	if err := os.WriteFile(filepath.Join(dir, "marks"), []byte(marks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testFile := media.File{Path: input, Name: "Tatort", Subtitle: "Borowski; und der Engel",
+		MetadataLog: []string{"Duration=01:30", "Description=Kiel=Hafen", "Episode=1024"}}
+
+	path, err := writeMetadata(testFile, 6000, &Trim{240, 5640}, config.Metadata{Chapters: true, EpgTags: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	content, _ := os.ReadFile(path)
+	want := strings.Join([]string{";FFMETADATA1", "title=Tatort", `subtitle=Borowski\; und der Engel`,
+		`description=Kiel\=Hafen`, "episode_id=1024",
+		"[CHAPTER]", "TIMEBASE=1/1000", "START=0", "END=2760480", "title=Chapter 1",
+		"[CHAPTER]", "TIMEBASE=1/1000", "START=2760480", "END=5400000", "title=Chapter 2", ""}, "\n")
+	if string(content) != want {
+		t.Errorf("writeMetadata() =\n%s\nwant\n%s", content, want)
+	}
+
+	if path, _ := writeMetadata(media.File{Path: filepath.Join(t.TempDir(), "other.mkv")}, 6000, nil, config.Metadata{Chapters: true}); path != "" {
+		t.Errorf("expected no metadata file without marks, got %s", path)
+	}
+
+	// recordings that share a directory only use their own marks
+	shared := t.TempDir()
+	for _, name := range []string{"first.ts", "second.ts", "marks"} {
+		if err := os.WriteFile(filepath.Join(shared, name), []byte(marks), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(shared, "first.marks"), []byte("0:10:00.00\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := marksPath(media.File{Path: filepath.Join(shared, "first.ts")}); got != filepath.Join(shared, "first.marks") {
+		t.Errorf("expected the marks of the recording, got %s", got)
+	}
+	if path, _ := writeMetadata(media.File{Path: filepath.Join(shared, "second.ts")}, 6000, nil, config.Metadata{Chapters: true}); path != "" {
+		os.Remove(path)
+		t.Errorf("expected the marks of the directory to be ignored for a shared directory")
+	}
+}
@@ -0,0 +1,150 @@
+package encoder
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/tools"
+)
+
+// Fake is an encoder backend that doesn't require ffmpeg, it is meant for tests.
+//
+// It is safe for concurrent use and writes an output file whose size is proportional to the encoded duration and emits progress lines
+type Fake struct {
+	// BytesPerSecond is the output size per encoded second of the input
+	BytesPerSecond int64
+	// Size is the output size if the encoded duration is unknown
+	Size int64
+	// ExitCode is returned without writing any output if it is not 0
+	ExitCode int
+	// Steps is the number of progress lines that are emitted, defaults to 4
+	Steps int
+	// StepDelay is the time spent on each progress step
+	StepDelay time.Duration
+	// Valid is the result of Verify
+	Valid bool
+	// Quality is the result of Compare
+	Quality Quality
+	// Black and Silence are the intervals reported by Detect
+	Black   []Interval
+	Silence []Interval
+	// ProbeFunc provides the result of Probe, probing is unsupported if it is nil
+	ProbeFunc func(path string) (tools.ProbeInfo, error)
+
+	mutex   sync.Mutex
+	calls   []Request
+	stopped atomic.Bool
+}
+
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+func (f *Fake) Call(req Request) string {
+	return fmt.Sprintf("fake -ss %d -t %d -i %s %s %s %s", req.Start, req.Duration, req.Input,
+		strings.Join(req.PreArguments, " "), strings.Join(req.PostArguments, " "), req.OutPath)
+}
+
+func (f *Fake) Run(req Request) (int, bool, error) {
+	f.mutex.Lock()
+	f.calls = append(f.calls, req)
+	f.mutex.Unlock()
+	f.stopped.Store(false)
+
+	if _, err := os.Stat(req.OutPath); err == nil && !req.Overwrite {
+		return 1, true, nil
+	}
+	if f.ExitCode != 0 {
+		return f.ExitCode, false, nil
+	}
+
+	size := f.Size
+	if req.Duration > 0 {
+		size = f.BytesPerSecond * int64(req.Duration)
+	}
+	steps := f.Steps
+	if steps <= 0 {
+		steps = 4
+	}
+	for step := 1; step <= steps; step++ {
+		if f.stopped.Load() {
+			return 255, false, nil
+		}
+		time.Sleep(f.StepDelay)
+		progress := float64(step) / float64(steps) * 100
+		if req.Slice != nil {
+			req.Slice.SetPosition(time.Duration(progress/100*float64(req.Duration)*float64(time.Second)), progress)
+			continue
+		}
+		line := fmt.Sprintf("fake: pass %d/%d encoded %.0f%% of %s", state.Encoder.Pass, state.Encoder.OfPasses, progress, req.Input)
+		state.Encoder.LineOut = append(state.Encoder.LineOut, line)
+		state.Encoder.Progress = progress
+	}
+
+	if req.OutPath == os.DevNull {
+		return 0, false, nil
+	}
+	out, err := os.Create(req.OutPath)
+	if err != nil {
+		return -1337, false, err
+	}
+	defer out.Close()
+	if err := out.Truncate(size); err != nil {
+		return 1, false, nil
+	}
+	return 0, false, nil
+}
+
+func (f *Fake) Verify(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		return false, err
+	}
+	if !f.Valid {
+		return false, errors.New("fake verification failed")
+	}
+	return true, nil
+}
+
+func (f *Fake) Compare(source string, output string, start int, length int, sourceOffset int) (Quality, error) {
+	if _, err := os.Stat(output); err != nil {
+		return Quality{}, err
+	}
+	return f.Quality, nil
+}
+
+func (f *Fake) Detect(path string, start int, length int, settings config.Trimming) ([]Interval, []Interval, error) {
+	within := func(intervals []Interval) []Interval {
+		found := make([]Interval, 0)
+		for _, interval := range intervals {
+			if interval.End > float64(start) && interval.Start < float64(start+length) {
+				found = append(found, interval)
+			}
+		}
+		return found
+	}
+	return within(f.Black), within(f.Silence), nil
+}
+
+func (f *Fake) Probe(path string) (tools.ProbeInfo, error) {
+	if f.ProbeFunc == nil {
+		return tools.ProbeInfo{}, errors.New("fake probing unsupported")
+	}
+	return f.ProbeFunc(path)
+}
+
+func (f *Fake) Stop() {
+	f.stopped.Store(true)
+}
+
+// Calls returns all requests the backend has received
+func (f *Fake) Calls() []Request {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]Request(nil), f.calls...)
+}
@@ -0,0 +1,439 @@
+package encoder
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/tools"
+	"github.com/kpango/glg"
+)
+
+// FFmpeg is the default encoder backend that runs ffmpeg as a child process
+type FFmpeg struct {
+	mutex   sync.Mutex
+	running map[*exec.Cmd]io.WriteCloser
+}
+
+func (f *FFmpeg) Name() string {
+	return "ffmpeg"
+}
+
+func (f *FFmpeg) params(req Request) []string {
+	// allow overwrite setting
+	params := make([]string, 0)
+	if req.Overwrite {
+		params = append(params, "-y")
+	} else {
+		params = append(params, "-n")
+	}
+	params = append(params, req.PreArguments...)
+	if req.Start > 0 {
+		params = append(params, "-ss", strconv.Itoa(req.Start))
+	}
+	params = append(params, "-i", req.Input)
+	if len(req.Metadata) > 0 {
+		params = append(params, "-i", req.Metadata)
+	}
+	if req.Duration > 0 {
+		params = append(params, "-t", strconv.Itoa(req.Duration))
+	}
+	params = append(params, req.PostArguments...)
+	if len(req.Metadata) > 0 {
+		params = append(params, "-map_metadata", "1", "-map_chapters", "1")
+	}
+	return params
+}
+
+func (f *FFmpeg) Call(req Request) string {
+	return strings.Join(f.params(req), " ")
+}
+
+func (f *FFmpeg) Run(req Request) (int, bool, error) {
+	cfg := config.Instance()
+	params := append(f.params(req), req.OutPath)
+	cmd := exec.Command("ffmpeg", params...)
+	stderr, _ := cmd.StderrPipe()
+	stdout, _ := cmd.StdoutPipe()
+	stdin, _ := cmd.StdinPipe()
+	multiReader := io.MultiReader(stderr, stdout)
+	f.mutex.Lock()
+	if err := cmd.Start(); err != nil {
+		f.mutex.Unlock()
+		return -1337, false, err
+	}
+	if f.running == nil {
+		f.running = make(map[*exec.Cmd]io.WriteCloser)
+	}
+	f.running[cmd] = stdin
+	f.mutex.Unlock()
+	defer func() {
+		f.mutex.Lock()
+		delete(f.running, cmd)
+		f.mutex.Unlock()
+	}()
+
+	if err := setPriority(cmd.Process.Pid, cfg.Local.EncoderPriority); err != nil {
+		_ = glg.Warnf("could not set priority %s for ffmpeg using pid %d, err: %s",
+			cfg.Local.EncoderPriority, cmd.Process.Pid, err)
+	}
+
+	// scan stdout
+	scanner := bufio.NewScanner(multiReader)
+	scanner.Split(ScanLinesSTDOUT)
+	fileExistsReturnCode := false
+	for scanner.Scan() {
+		if req.Slice != nil {
+			if parseSliceOut(scanner.Text(), req) {
+				fileExistsReturnCode = true
+			}
+		} else if parseOut(scanner.Text(), req.FixedDuration) {
+			fileExistsReturnCode = true
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		_ = glg.Errorf("ffmpeg error: %s", err)
+	}
+	return cmd.ProcessState.ExitCode(), fileExistsReturnCode, nil
+}
+
+func (f *FFmpeg) Verify(path string) (bool, error) {
+	return tools.FfProbeVerfiy(path)
+}
+
+func (f *FFmpeg) Probe(path string) (tools.ProbeInfo, error) {
+	return tools.FfProbeInfo(path)
+}
+
+var (
+	ssimRegex = regexp.MustCompile(`SSIM .*All:([0-9.]+)`)
+	psnrRegex = regexp.MustCompile(`PSNR .*average:([0-9.]+|inf)`)
+	vmafRegex = regexp.MustCompile(`VMAF score: ([0-9.]+)`)
+
+	vmafOnce      sync.Once
+	vmafAvailable bool
+)
+
+// Compare scales the output to the size of the source and runs the ssim, psnr and libvmaf filters on them
+func (f *FFmpeg) Compare(source string, output string, start int, length int, sourceOffset int) (Quality, error) {
+	vmafOnce.Do(func() {
+		filters, err := exec.Command("ffmpeg", "-hide_banner", "-filters").Output()
+		vmafAvailable = err == nil && strings.Contains(string(filters), " libvmaf ")
+	})
+	filter := "[0:v][1:v]scale2ref=flags=bicubic[dist][ref];"
+	if vmafAvailable {
+		filter += "[dist]split=3[d0][d1][d2];[ref]split=3[r0][r1][r2];[d0][r0]ssim;[d1][r1]psnr;[d2][r2]libvmaf"
+	} else {
+		filter += "[dist]split=2[d0][d1];[ref]split=2[r0][r1];[d0][r0]ssim;[d1][r1]psnr"
+	}
+	params := []string{"-hide_banner", "-nostats",
+		"-ss", strconv.Itoa(start), "-t", strconv.Itoa(length), "-i", output,
+		"-ss", strconv.Itoa(start + sourceOffset), "-t", strconv.Itoa(length), "-i", source,
+		"-lavfi", filter, "-f", "null", "-"}
+	out, err := f.runAnalysis(params)
+	if err != nil {
+		return Quality{}, fmt.Errorf("ffmpeg quality comparison failed: %w", err)
+	}
+
+	quality := Quality{VMAFAvailable: vmafAvailable}
+	match := ssimRegex.FindStringSubmatch(out.String())
+	if match == nil {
+		return Quality{}, errors.New("no ssim score in ffmpeg output")
+	}
+	quality.SSIM, _ = strconv.ParseFloat(match[1], 64)
+	if match = psnrRegex.FindStringSubmatch(out.String()); match == nil {
+		return Quality{}, errors.New("no psnr score in ffmpeg output")
+	}
+	// identical frames have an infinite psnr
+	if match[1] == "inf" {
+		quality.PSNR = math.Inf(1)
+	} else {
+		quality.PSNR, _ = strconv.ParseFloat(match[1], 64)
+	}
+	if vmafAvailable {
+		if match = vmafRegex.FindStringSubmatch(out.String()); match != nil {
+			quality.VMAF, _ = strconv.ParseFloat(match[1], 64)
+		} else {
+			quality.VMAFAvailable = false
+		}
+	}
+	return quality, nil
+}
+
+var (
+	blackRegex        = regexp.MustCompile(`black_start:\s*([0-9.]+)\s+black_end:\s*([0-9.]+)`)
+	silenceStartRegex = regexp.MustCompile(`silence_start:\s*(-?[0-9.]+)`)
+	silenceEndRegex   = regexp.MustCompile(`silence_end:\s*([0-9.]+)`)
+)
+
+// Detect runs the blackdetect and silencedetect filters on a segment of the file
+func (f *FFmpeg) Detect(path string, start int, length int, settings config.Trimming) ([]Interval, []Interval, error) {
+	params := []string{"-hide_banner", "-nostats", "-ss", strconv.Itoa(start), "-t", strconv.Itoa(length), "-i", path,
+		"-vf", fmt.Sprintf("blackdetect=d=%g:pix_th=0.10", settings.MinBlack),
+		"-af", fmt.Sprintf("silencedetect=n=%s:d=%g", settings.SilenceNoise, settings.MinSilence),
+		"-f", "null", "-"}
+	out, err := f.runAnalysis(params)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ffmpeg black and silence detection failed: %w", err)
+	}
+
+	// timestamps restart at 0 after seeking the input
+	offset := float64(start)
+	black := make([]Interval, 0)
+	for _, match := range blackRegex.FindAllStringSubmatch(out.String(), -1) {
+		blackStart, _ := strconv.ParseFloat(match[1], 64)
+		blackEnd, _ := strconv.ParseFloat(match[2], 64)
+		black = append(black, Interval{blackStart + offset, blackEnd + offset})
+	}
+	silence := make([]Interval, 0)
+	// a silence_end without silence_start means the segment starts silent
+	silenceStart := 0.0
+	for _, line := range strings.Split(out.String(), "\n") {
+		if match := silenceStartRegex.FindStringSubmatch(line); match != nil {
+			silenceStart, _ = strconv.ParseFloat(match[1], 64)
+		} else if match := silenceEndRegex.FindStringSubmatch(line); match != nil {
+			silenceEnd, _ := strconv.ParseFloat(match[1], 64)
+			silence = append(silence, Interval{math.Max(silenceStart, 0) + offset, silenceEnd + offset})
+			silenceStart = silenceEnd
+		}
+	}
+	return black, silence, nil
+}
+
+// runAnalysis runs ffmpeg with the encoder priority and returns its combined output,
+// the process is stopped by Stop like an encode
+func (f *FFmpeg) runAnalysis(params []string) (*bytes.Buffer, error) {
+	cmd := exec.Command("ffmpeg", params...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	stdin, _ := cmd.StdinPipe()
+	f.mutex.Lock()
+	if cancelled.Load() {
+		f.mutex.Unlock()
+		return nil, ErrCancelled
+	}
+	if err := cmd.Start(); err != nil {
+		f.mutex.Unlock()
+		return nil, err
+	}
+	if f.running == nil {
+		f.running = make(map[*exec.Cmd]io.WriteCloser)
+	}
+	f.running[cmd] = stdin
+	f.mutex.Unlock()
+	defer func() {
+		f.mutex.Lock()
+		delete(f.running, cmd)
+		f.mutex.Unlock()
+	}()
+
+	cfg := config.Instance()
+	if err := setPriority(cmd.Process.Pid, cfg.Local.EncoderPriority); err != nil {
+		_ = glg.Warnf("could not set priority %s for ffmpeg using pid %d, err: %s",
+			cfg.Local.EncoderPriority, cmd.Process.Pid, err)
+	}
+	if err := cmd.Wait(); err != nil {
+		if cancelled.Load() {
+			return nil, ErrCancelled
+		}
+		return nil, err
+	}
+	if cancelled.Load() {
+		return nil, ErrCancelled
+	}
+	return &out, nil
+}
+
+var (
+	timeRegex  = regexp.MustCompile(`time=\s*(\d+):(\d+):(\d+(?:\.\d+)?)`)
+	speedRegex = regexp.MustCompile(`speed=\s*([0-9.]+)x`)
+)
+
+// parseSliceOut updates the progress of a slice encode, it returns true if ffmpeg refuses to overwrite the output
+func parseSliceOut(line string, req Request) bool {
+	if strings.Contains(line, "already exists. Exiting.") {
+		return true
+	}
+	if match := timeRegex.FindStringSubmatch(line); match != nil {
+		hours, _ := strconv.Atoi(match[1])
+		minutes, _ := strconv.Atoi(match[2])
+		seconds, _ := strconv.ParseFloat(match[3], 64)
+		position := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+			time.Duration(seconds*float64(time.Second))
+		var progress float64
+		if req.Duration > 0 {
+			progress = position.Seconds() / float64(req.Duration) * 100
+		}
+		req.Slice.SetPosition(position, progress)
+	}
+	if match := speedRegex.FindStringSubmatch(line); match != nil {
+		speed, _ := strconv.ParseFloat(match[1], 64)
+		req.Slice.SetSpeed(speed)
+	}
+	return false
+}
+
+// Stop asks all running ffmpeg processes to quit gracefully and kills them if they don't exit within 10 seconds
+func (f *FFmpeg) Stop() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for cmd, stdin := range f.running {
+		if cmd.Process == nil {
+			continue
+		}
+		_ = glg.Infof("cancelling ffmpeg process %d", cmd.Process.Pid)
+		if _, err := io.WriteString(stdin, "q\n"); err != nil {
+			_ = glg.Warnf("could not ask ffmpeg to quit, killing it: %s", err)
+			_ = cmd.Process.Kill()
+			continue
+		}
+		go func(cmd *exec.Cmd) {
+			time.Sleep(10 * time.Second)
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+			if _, ok := f.running[cmd]; ok {
+				_ = glg.Warnf("ffmpeg did not quit in time, killing process %d", cmd.Process.Pid)
+				_ = cmd.Process.Kill()
+			}
+		}(cmd)
+	}
+}
+
+func ScanLinesSTDOUT(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		// We have a full newline-terminated line.
+		return i + 1, data[0:i], nil
+	} else if i := bytes.IndexByte(data, '\r'); i >= 0 {
+		// We have a refresh that needs to be printed
+		return i + 1, data[0:i], nil
+	}
+	// If we're at EOF, we have a final, non-terminated line. Return it.
+	if atEOF {
+		return len(data), data, nil
+	}
+	// Request more data.
+	return 0, nil, nil
+}
+
+func parseOut(line string, customDuration bool) (fileExists bool) {
+	durationToken := "Duration:"
+	frameToken := "frame"
+	fpsToken := "fps"
+	qToken := "q"
+	sizeToken := "size"
+	timeToken := "time"
+	bitrateToken := "bitrate"
+	dupToken := "dup"
+	dropToken := "drop"
+	speedToken := "speed"
+	fileExistsToken := "already exists. Exiting."
+
+	state.Encoder.LineOut = append(state.Encoder.LineOut, line)
+	if !customDuration && strings.Contains(line, durationToken) {
+		//fmt.Println(line)
+		_ = glg.Log(line)
+		keyIdx := strings.Index(line, durationToken) + len(durationToken)
+		timeIdx := strings.Index(line, ".")
+		state.Encoder.Duration, _ = time.Parse("15:04:05", strings.Trim(line[keyIdx:timeIdx], " "))
+		// safe enough for now
+	} else if strings.Contains(line, frameToken) {
+		// ffmpeg out looks like this:
+		// frame=  272 fps=271 q=15.0 size=     512kB time=00:00:11.07 bitrate= 378.8kbits/s dup=0 drop=269 speed=  11x
+		separated := make([]string, 0)
+		splitEq := strings.Split(line, "=")
+		for idx := range splitEq {
+			splitWs := strings.Split(strings.Trim(splitEq[idx], " "), " ")
+			separated = append(separated, splitWs...)
+		}
+		statMap := make(map[string]string)
+		for idx := 0; idx < len(separated)-1; idx += 2 {
+			statMap[separated[idx]] = separated[idx+1]
+		}
+
+		if val, ok := statMap[frameToken]; ok {
+			frameParse, _ := strconv.ParseInt(val, 10, 32)
+			state.Encoder.Frame = int(frameParse)
+		}
+		if val, ok := statMap[fpsToken]; ok {
+			state.Encoder.Fps, _ = strconv.ParseFloat(val, 64)
+		}
+		if val, ok := statMap[qToken]; ok {
+			state.Encoder.Q, _ = strconv.ParseFloat(val, 64)
+		}
+		if val, ok := statMap[sizeToken]; ok {
+			state.Encoder.Size = val
+		}
+		if val, ok := statMap[timeToken]; ok {
+			cutIdx := strings.Index(val, ".")
+			if cutIdx != -1 {
+				state.Encoder.Position, _ = time.Parse("15:04:05", val)
+			}
+		}
+		if val, ok := statMap[bitrateToken]; ok {
+			state.Encoder.Bitrate = val
+		}
+		if val, ok := statMap[dupToken]; ok {
+			dupParse, _ := strconv.ParseInt(val, 10, 32)
+			state.Encoder.Dup = int(dupParse)
+		}
+		if val, ok := statMap[dropToken]; ok {
+			dropParse, _ := strconv.ParseInt(val, 10, 32)
+			state.Encoder.Drop = int(dropParse)
+		}
+		if val, ok := statMap[speedToken]; ok {
+			cutIdx := strings.Index(val, "x")
+			if cutIdx != -1 {
+				state.Encoder.Speed, _ = strconv.ParseFloat(strings.Trim(val[:cutIdx], " "), 64)
+			}
+		}
+
+		if state.Encoder.Speed > 0 {
+			// calculate ETA
+			//fmt.Printf("Duration: %s\n", state.Encoder.Duration)
+			//fmt.Printf("Position: %s\n", state.Encoder.Position)
+			diff := state.Encoder.Duration.Sub(state.Encoder.Position)
+			//fmt.Printf("Difference: %s\n", diff)
+			if speed := time.Duration(state.Encoder.Speed); speed > 0 {
+				diff /= speed
+			}
+			state.Encoder.Remaining = diff
+		}
+		durationDuration := state.Encoder.Duration.Sub(new(time.Time).AddDate(-1, 0, 0)).Seconds()
+		positionDuration := state.Encoder.Position.Sub(new(time.Time).AddDate(-1, 0, 0)).Seconds()
+		state.Encoder.Progress = (positionDuration / durationDuration) * 100
+		termOut := ""
+		if state.Encoder.OfPasses > 1 {
+			termOut += fmt.Sprintf("Pass: %d/%d ", state.Encoder.Pass, state.Encoder.OfPasses)
+		}
+		termOut += fmt.Sprintf("Duration: %s ", state.Encoder.Duration.Format("15:04:05"))
+		termOut += fmt.Sprintf("Frame: %d ", state.Encoder.Frame)
+		termOut += fmt.Sprintf("Fps: %.2f ", state.Encoder.Fps)
+		termOut += fmt.Sprintf("Q: %.0f ", state.Encoder.Q)
+		termOut += fmt.Sprintf("Size: %s ", state.Encoder.Size)
+		termOut += fmt.Sprintf("Position: %s ", state.Encoder.Position.Format("15:04:05"))
+		termOut += fmt.Sprintf("Bitrate: %s ", state.Encoder.Bitrate)
+		termOut += fmt.Sprintf("Dup: %d ", state.Encoder.Dup)
+		termOut += fmt.Sprintf("Drop: %d ", state.Encoder.Drop)
+		termOut += fmt.Sprintf("Speed: %.1f ", state.Encoder.Speed)
+		termOut += fmt.Sprintf("Remaining: %s", state.Encoder.Remaining)
+		_ = glg.Log(termOut)
+		//fmt.Printf("\r" + termOut)
+	} else if strings.Contains(line, fileExistsToken) {
+		return true
+	}
+	return false
+}
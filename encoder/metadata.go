@@ -0,0 +1,187 @@
+package encoder
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/consts"
+	"github.com/Spiritreader/avior-go/media"
+	"github.com/rs/xid"
+)
+
+// vdrFrameRate is used to convert the frame part of VDR marks, recordings are PAL
+const vdrFrameRate = 25
+
+// readMarks reads the positions in seconds of a VDR marks file.
+//
+// Every line starts with a position in the format h:mm:ss.ff where ff is the frame number
+func readMarks(path string) ([]float64, error) {
+	handle, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	marks := make([]float64, 0)
+	scanner := bufio.NewScanner(handle)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		position, frames, _ := strings.Cut(fields[0], ".")
+		hms := strings.Split(position, ":")
+		if len(hms) != 3 {
+			continue
+		}
+		seconds := 0.0
+		valid := true
+		for _, part := range hms {
+			value, err := strconv.Atoi(part)
+			if err != nil {
+				valid = false
+				break
+			}
+			seconds = seconds*60 + float64(value)
+		}
+		if !valid {
+			continue
+		}
+		if frame, err := strconv.Atoi(frames); err == nil {
+			seconds += float64(frame) / vdrFrameRate
+		}
+		marks = append(marks, seconds)
+	}
+	return marks, scanner.Err()
+}
+
+// marksPath returns <stem>.marks of the recording, if there is none the marks file VDR writes into
+// the recording directory is used, as long as the recording is the only one in its directory
+func marksPath(file media.File) string {
+	own := strings.TrimSuffix(file.Path, filepath.Ext(file.Path)) + ".marks"
+	if _, err := os.Stat(own); err == nil || !onlyRecording(file) {
+		return own
+	}
+	dir := filepath.Dir(file.Path)
+	for _, name := range []string{"marks", "marks.vdr"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return filepath.Join(dir, name)
+		}
+	}
+	return own
+}
+
+// onlyRecording reports whether no other file with the extension of the recording shares its directory
+func onlyRecording(file media.File) bool {
+	entries, err := os.ReadDir(filepath.Dir(file.Path))
+	if err != nil {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(file.Path))
+	for _, entry := range entries {
+		if !entry.IsDir() && entry.Name() != filepath.Base(file.Path) && strings.ToLower(filepath.Ext(entry.Name())) == ext {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeMetadata escapes the special characters of the ffmetadata format
+func escapeMetadata(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "=", `\=`, ";", `\;`, "#", `\#`, "\n", "\\\n")
+	return replacer.Replace(value)
+}
+
+// writeMetadata writes an ffmetadata file with epg tags and chapters from the VDR marks of the file.
+//
+// total is the duration of the source in seconds, chapters are shifted to the trimmed output if trim is set.
+// It returns an empty path if there is no metadata
+func writeMetadata(file media.File, total float64, trim *Trim, settings config.Metadata) (string, error) {
+	lines := []string{";FFMETADATA1"}
+	if settings.EpgTags {
+		tags := []struct {
+			key   string
+			value string
+		}{
+			{"title", file.Name},
+			{"subtitle", file.Subtitle},
+			{"description", file.Metadata("Description")},
+			{"season_number", file.Metadata("Season")},
+			{"episode_id", file.Metadata("Episode")},
+		}
+		for _, tag := range tags {
+			if len(tag.value) > 0 {
+				lines = append(lines, fmt.Sprintf("%s=%s", tag.key, escapeMetadata(tag.value)))
+			}
+		}
+	}
+
+	if settings.Chapters {
+		marks, err := readMarks(marksPath(file))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		start, end := 0.0, total
+		if trim != nil {
+			start, end = trim.Start, trim.End
+		}
+		// chapters start at every mark within the output
+		points := []float64{0}
+		for _, mark := range marks {
+			if position := mark - start; position > 1 && mark < end-1 {
+				points = append(points, position)
+			}
+		}
+		if len(points) > 1 {
+			for idx, point := range points {
+				chapterEnd := end - start
+				if idx < len(points)-1 {
+					chapterEnd = points[idx+1]
+				}
+				lines = append(lines, "[CHAPTER]", "TIMEBASE=1/1000",
+					fmt.Sprintf("START=%d", int64(math.Round(point*1000))),
+					fmt.Sprintf("END=%d", int64(math.Round(chapterEnd*1000))),
+					fmt.Sprintf("title=Chapter %d", idx+1))
+			}
+		}
+	}
+
+	if len(lines) == 1 {
+		return "", nil
+	}
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("avior-%s.ffmeta", xid.New()))
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// aviorTags returns the -metadata arguments that record the origin of an encode
+func aviorTags(file media.File, profile string) []string {
+	hostname, _ := os.Hostname()
+	tags := [][2]string{
+		{consts.TAG_SOURCE, file.Path},
+		{consts.TAG_HOST, hostname},
+		{consts.TAG_REPLACEMENT, state.Encoder.ReplacementReason},
+		{consts.TAG_PROFILE, profile},
+		{consts.TAG_ENCODED, time.Now().Format(time.RFC3339)},
+		{consts.TAG_RECORDED_LENGTH, strconv.Itoa(file.RecordedLength)},
+		{consts.TAG_LENGTH, strconv.Itoa(file.Length)},
+		{consts.TAG_ERRORS, strconv.Itoa(file.Errors)},
+		{consts.TAG_AUDIO_FORMAT, strconv.Itoa(int(file.AudioFormat))},
+		{consts.TAG_RESOLUTION, file.Resolution.Tag + ":" + file.Resolution.Value},
+	}
+	args := make([]string, 0, len(tags)*2)
+	for _, tag := range tags {
+		if len(tag[1]) > 0 {
+			args = append(args, "-metadata", tag[0]+"="+tag[1])
+		}
+	}
+	return args
+}
@@ -0,0 +1,60 @@
+//go:build linux
+
+package encoder
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/kpango/glg"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+	ioprioWhoProcess = 1
+)
+
+// linuxPriority maps a priority class to a nice value and an io priority
+func linuxPriority(priority config.Priority) (nice int, ioprio int) {
+	switch priority {
+	case config.PRIORITY_HIGH:
+		return -10, ioprioClassBE<<ioprioClassShift | 0
+	case config.PRIORITY_ABOVE_NORMAL:
+		return -5, ioprioClassBE<<ioprioClassShift | 2
+	case config.PRIORITY_NORMAL:
+		return 0, ioprioClassBE<<ioprioClassShift | 4
+	case config.PRIORITY_BELOW_NORMAL:
+		return 10, ioprioClassBE<<ioprioClassShift | 6
+	}
+	return 19, ioprioClassIdle << ioprioClassShift
+}
+
+// setPriority applies the configured encoder priority as nice value and io priority
+//
+// nice values are per thread on linux, so all threads that ffmpeg has spawned so far are updated as well
+func setPriority(pid int, priority string) error {
+	nice, ioprio := linuxPriority(config.Priority(config.PriorityUint32(priority)))
+	tids := []int{pid}
+	if entries, err := os.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "task")); err == nil {
+		for _, entry := range entries {
+			if tid, err := strconv.Atoi(entry.Name()); err == nil && tid != pid {
+				tids = append(tids, tid)
+			}
+		}
+	}
+	var firstErr error
+	for _, tid := range tids {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, nice); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); errno != 0 {
+			_ = glg.Warnf("could not set io priority for ffmpeg thread %d, err: %s", tid, errno)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,21 @@
+//go:build !windows && !linux
+
+package encoder
+
+import (
+	"errors"
+	"sync"
+)
+
+var priorityOnce sync.Once
+
+// setPriority is not supported on this platform, ffmpeg runs with the default priority.
+//
+// The error is only returned for the first process, so the warning isn't logged for every encode and slice
+func setPriority(pid int, priority string) error {
+	var err error
+	priorityOnce.Do(func() {
+		err = errors.New("process priority is not supported on this platform")
+	})
+	return err
+}
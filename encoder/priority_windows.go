@@ -0,0 +1,24 @@
+//go:build windows
+
+package encoder
+
+import (
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/kpango/glg"
+	"golang.org/x/sys/windows"
+)
+
+// setPriority applies the configured encoder priority as a windows priority class
+func setPriority(pid int, priority string) error {
+	hProcess, err := windows.OpenProcess(0x0400|0x0200, false, uint32(pid))
+	if err != nil {
+		_ = glg.Warnf("could not get ffmpeg handle using pid %d, err: %s", pid, err)
+		return err
+	}
+	defer func() {
+		if err := windows.CloseHandle(hProcess); err != nil {
+			_ = glg.Errorf("could not close handle for pid %d, err: %s", pid, err)
+		}
+	}()
+	return windows.SetPriorityClass(hProcess, config.PriorityUint32(priority))
+}
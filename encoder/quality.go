@@ -0,0 +1,92 @@
+package encoder
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/media"
+	"github.com/kpango/glg"
+)
+
+var ErrLowQuality = errors.New("encode quality below threshold")
+
+// Quality holds the scores of an encode compared to its source
+type Quality struct {
+	SSIM float64
+	PSNR float64
+	// VMAF is only set if VMAFAvailable is true
+	VMAF          float64
+	VMAFAvailable bool
+}
+
+func (q Quality) String() string {
+	out := fmt.Sprintf("SSIM %.4f, PSNR %.2f dB", q.SSIM, q.PSNR)
+	if q.VMAFAvailable {
+		out += fmt.Sprintf(", VMAF %.2f", q.VMAF)
+	}
+	return out
+}
+
+// passes reports whether the scores satisfy all minimums of the quality gate
+func (q Quality) passes(gate config.QualityGate) bool {
+	if gate.MinSSIM > 0 && q.SSIM < gate.MinSSIM {
+		return false
+	}
+	if gate.MinPSNR > 0 && q.PSNR < gate.MinPSNR {
+		return false
+	}
+	if gate.MinVMAF > 0 && q.VMAFAvailable && q.VMAF < gate.MinVMAF {
+		return false
+	}
+	return true
+}
+
+// measureQuality compares evenly spread samples of the output with the source and averages their scores
+//
+// offset is the position in seconds of the output's start in the source and duration the output's length, 0 if unknown
+func measureQuality(backend Encoder, file media.File, outPath string, offset int, duration int, gate config.QualityGate) (Quality, error) {
+	samples := gate.Samples
+	if samples <= 0 {
+		samples = 1
+	}
+	length := gate.SampleLength
+	if length <= 0 {
+		length = 10
+	}
+	// without a known length, the beginning of the file is compared
+	step := 0
+	if duration <= 0 {
+		duration = file.RecordedLength * 60
+	}
+	if duration > 0 {
+		step = duration / (samples + 1)
+		if step < length {
+			samples = 1
+			step = 0
+		}
+	} else {
+		samples = 1
+	}
+
+	avg := Quality{VMAFAvailable: true}
+	for idx := 0; idx < samples; idx++ {
+		start := step * (idx + 1)
+		if step == 0 {
+			start = 0
+		}
+		quality, err := backend.Compare(file.Path, outPath, start, length, offset)
+		if err != nil {
+			return Quality{}, err
+		}
+		_ = glg.Infof("quality sample %d/%d at %ds: %s", idx+1, samples, start, quality)
+		avg.SSIM += quality.SSIM / float64(samples)
+		avg.PSNR += quality.PSNR / float64(samples)
+		avg.VMAF += quality.VMAF / float64(samples)
+		avg.VMAFAvailable = avg.VMAFAvailable && quality.VMAFAvailable
+	}
+	if !avg.VMAFAvailable {
+		avg.VMAF = 0
+	}
+	return avg, nil
+}
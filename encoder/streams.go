@@ -0,0 +1,99 @@
+package encoder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/tools"
+	"github.com/kpango/glg"
+)
+
+// language codes and titles broadcasters use for audio description
+var (
+	audioDescriptionLanguages = []string{"qad", "mis"}
+	audioDescriptionTitles    = []string{"audiodeskription", "audio description", "hörfilm"}
+)
+
+func isAudioDescription(stream tools.ProbeStream) bool {
+	if stream.VisualImpaired {
+		return true
+	}
+	for _, language := range audioDescriptionLanguages {
+		if strings.EqualFold(stream.Language, language) {
+			return true
+		}
+	}
+	title := strings.ToLower(stream.Title)
+	for _, adTitle := range audioDescriptionTitles {
+		if strings.Contains(title, adTitle) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectStreams returns the streams of the source that are kept by the policy
+func selectStreams(info tools.ProbeInfo, policy config.StreamPolicy) []tools.ProbeStream {
+	video := make([]tools.ProbeStream, 0)
+	audio := make([]tools.ProbeStream, 0)
+	allAudio := make([]tools.ProbeStream, 0)
+	subtitles := make([]tools.ProbeStream, 0)
+	for _, stream := range info.Streams {
+		switch stream.CodecType {
+		case "video":
+			video = append(video, stream)
+		case "audio":
+			if policy.DropAudioDescription && isAudioDescription(stream) {
+				_ = glg.Infof("dropping audio description stream %d (%s)", stream.Index, stream.Language)
+				continue
+			}
+			allAudio = append(allAudio, stream)
+			if len(policy.AudioLanguages) == 0 {
+				audio = append(audio, stream)
+				continue
+			}
+			for _, language := range policy.AudioLanguages {
+				if strings.EqualFold(stream.Language, language) {
+					audio = append(audio, stream)
+					break
+				}
+			}
+		case "subtitle":
+			if (stream.CodecName == "dvb_subtitle" && policy.KeepSubtitles) ||
+				(stream.CodecName == "dvb_teletext" && policy.KeepTeletext) {
+				subtitles = append(subtitles, stream)
+			}
+		}
+	}
+	// never produce a silent file because no stream matches the languages
+	if len(audio) == 0 {
+		if len(allAudio) > 0 {
+			_ = glg.Warnf("no audio stream in languages %v, keeping all audio streams", policy.AudioLanguages)
+		}
+		audio = allAudio
+	}
+	selected := append(video, audio...)
+	return append(selected, subtitles...)
+}
+
+// mapArguments returns the -map arguments for the selected streams and the codec arguments for kept subtitles
+func mapArguments(selected []tools.ProbeStream) []string {
+	args := make([]string, 0)
+	subtitleIdx := 0
+	codecArgs := make([]string, 0)
+	for _, stream := range selected {
+		args = append(args, "-map", fmt.Sprintf("0:%d", stream.Index))
+		if stream.CodecType != "subtitle" {
+			continue
+		}
+		// matroska can't hold teletext, it is converted to text subtitles
+		codec := "copy"
+		if stream.CodecName == "dvb_teletext" {
+			codec = "srt"
+		}
+		codecArgs = append(codecArgs, fmt.Sprintf("-c:s:%d", subtitleIdx), codec)
+		subtitleIdx++
+	}
+	return append(args, codecArgs...)
+}
@@ -0,0 +1,96 @@
+package encoder
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/media"
+	"github.com/kpango/glg"
+)
+
+// Trim is the part of a recording that contains the programme, in seconds
+type Trim struct {
+	Start float64
+	End   float64
+}
+
+func (t Trim) String() string {
+	format := func(seconds float64) string {
+		return new(time.Time).Add(time.Duration(seconds * float64(time.Second))).Format("15:04:05.0")
+	}
+	return fmt.Sprintf("%s - %s (%s)", format(t.Start), format(t.End),
+		time.Duration((t.End-t.Start)*float64(time.Second)).Round(time.Second))
+}
+
+// findTrim searches the padding at both ends of the recording for cut points at black frames and silence.
+//
+// total is the duration of the recording in seconds.
+// It returns nil if there is nothing to trim or no pair of cut points matches the EPG length
+func findTrim(backend Encoder, file media.File, total float64, settings config.Trimming) (*Trim, error) {
+	if file.Length <= 0 {
+		return nil, nil
+	}
+	expected := float64(file.Length * 60)
+	padding := total - expected
+	if padding <= 0 {
+		return nil, nil
+	}
+	window := math.Min(padding+float64(settings.SearchWindow), total)
+
+	black, silence, err := backend.Detect(file.Path, 0, int(math.Ceil(window)), settings)
+	if err != nil {
+		return nil, err
+	}
+	heads := append([]float64{0}, cutPoints(black, silence)...)
+	tailStart := math.Floor(total - window)
+	black, silence, err = backend.Detect(file.Path, int(tailStart), int(math.Ceil(total-tailStart)), settings)
+	if err != nil {
+		return nil, err
+	}
+	tails := append(cutPoints(black, silence), total)
+
+	var best *Trim
+	bestDiff := math.Inf(1)
+	for _, head := range heads {
+		for _, tail := range tails {
+			if tail <= head {
+				continue
+			}
+			if diff := math.Abs(tail - head - expected); diff < bestDiff {
+				bestDiff = diff
+				best = &Trim{head, tail}
+			}
+		}
+	}
+	if best == nil || bestDiff > float64(settings.Tolerance) {
+		_ = glg.Infof("no cut points match the epg length of %d minutes", file.Length)
+		return nil, nil
+	}
+	if best.Start == 0 && best.End == total {
+		return nil, nil
+	}
+	return best, nil
+}
+
+// cutPoints returns the middle of black intervals that are also silent.
+// If there are none, the middle of all black intervals is used
+func cutPoints(black []Interval, silence []Interval) []float64 {
+	points := make([]float64, 0)
+	for _, b := range black {
+		for _, s := range silence {
+			start, end := math.Max(b.Start, s.Start), math.Min(b.End, s.End)
+			if start < end {
+				points = append(points, (start+end)/2)
+			}
+		}
+	}
+	if len(points) > 0 {
+		return points
+	}
+	for _, b := range black {
+		points = append(points, (b.Start+b.End)/2)
+	}
+	return points
+}
@@ -0,0 +1,107 @@
+package encoder
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/media"
+	"github.com/Spiritreader/avior-go/tools"
+)
+
+var ErrVerification = errors.New("output does not match source")
+
+// verifyAgainstSource compares the duration, streams and channels of the output with the source file
+//
+// expected is the duration the output should have, 0 to use the duration of the source.
+// streams are the source streams that have been mapped to the output, nil if ffmpeg selected the default streams
+func verifyAgainstSource(backend Encoder, file media.File, outPath string, expected time.Duration,
+	streams []tools.ProbeStream, settings config.Verification) error {
+	source, err := backend.Probe(file.Path)
+	if err != nil {
+		return fmt.Errorf("could not probe source: %w", err)
+	}
+	output, err := backend.Probe(outPath)
+	if err != nil {
+		return fmt.Errorf("could not probe output: %w", err)
+	}
+	if expected == 0 {
+		expected = source.Duration
+	}
+	codecTypes := []string{"video", "audio", "subtitle"}
+	if streams == nil {
+		streams = defaultStreams(source)
+		// whether ffmpeg keeps a subtitle stream by default depends on the codec
+		codecTypes = codecTypes[:2]
+	}
+	mapped := tools.ProbeInfo{Streams: streams}
+
+	problems := make([]string, 0)
+	tolerance := time.Duration(settings.DurationTolerance) * time.Second
+	if diff := output.Duration - expected; diff > tolerance || diff < -tolerance {
+		problems = append(problems, fmt.Sprintf("duration %s, expected %s", output.Duration, expected))
+	}
+	if recorded := time.Duration(file.RecordedLength) * time.Minute; file.RecordedLength > 0 && expected >= recorded &&
+		output.Duration < recorded-time.Minute-tolerance {
+		problems = append(problems, fmt.Sprintf("duration %s, recorded length %s", output.Duration, recorded))
+	}
+	if settings.Streams {
+		for _, codecType := range codecTypes {
+			if output.Count(codecType) != mapped.Count(codecType) {
+				problems = append(problems, fmt.Sprintf("%d %s streams, expected %d",
+					output.Count(codecType), codecType, mapped.Count(codecType)))
+			}
+		}
+	}
+	if settings.Channels {
+		// the output keeps the order of the mapped streams
+		outputChannels, mappedChannels := audioChannels(output), audioChannels(mapped)
+		for idx := 0; idx < len(outputChannels) && idx < len(mappedChannels); idx++ {
+			if outputChannels[idx] != mappedChannels[idx] {
+				problems = append(problems, fmt.Sprintf("%d audio channels in audio stream %d, source has %d",
+					outputChannels[idx], idx, mappedChannels[idx]))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrVerification, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// defaultStreams returns the streams ffmpeg keeps without -map arguments,
+// the first video stream and the audio stream with the most channels
+func defaultStreams(source tools.ProbeInfo) []tools.ProbeStream {
+	selected := make([]tools.ProbeStream, 0)
+	var audio *tools.ProbeStream
+	for idx, stream := range source.Streams {
+		switch stream.CodecType {
+		case "video":
+			if len(selected) == 0 {
+				selected = append(selected, stream)
+			}
+		case "audio":
+			if audio == nil || stream.Channels > audio.Channels {
+				audio = &source.Streams[idx]
+			}
+		}
+	}
+	if audio != nil {
+		selected = append(selected, *audio)
+	}
+	return selected
+}
+
+// audioChannels returns the channel count of each audio stream in order
+func audioChannels(info tools.ProbeInfo) []int {
+	channels := make([]int, 0)
+	for _, stream := range info.Streams {
+		if stream.CodecType == "audio" {
+			channels = append(channels, stream.Channels)
+		}
+	}
+	return channels
+}
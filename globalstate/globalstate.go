@@ -1,6 +1,7 @@
 package globalstate
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -63,6 +64,8 @@ type Data struct {
 	ShutdownPending bool
 	HostName        string
 	Sleeping        bool
+	Shares          Shares
+	Janitor         Janitor
 }
 
 type Encoder struct {
@@ -80,17 +83,116 @@ type Encoder struct {
 	Speed             float64
 	Slice             int
 	OfSlices          int
+	Slices            []*SliceProgress
+	Pass              int
+	OfPasses          int
 	Remaining         time.Duration
 	Progress          float64
 	ReplacementReason string
 	OutPath           string
 }
 
+// SliceProgress is the progress of a slice that is encoded for a size estimation.
+//
+// Slices are encoded at the same time, their progress has to be changed through its methods
+type SliceProgress struct {
+	mutex    sync.Mutex
+	Slice    int
+	Active   bool
+	Done     bool
+	Position time.Duration
+	Speed    float64
+	Progress float64
+}
+
+// SetActive marks the slice as being encoded
+func (s *SliceProgress) SetActive(active bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Active = active
+}
+
+// SetDone marks the slice as encoded
+func (s *SliceProgress) SetDone() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Done = true
+}
+
+// SetPosition updates the encoded position and the progress in percent
+func (s *SliceProgress) SetPosition(position time.Duration, progress float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Position = position
+	s.Progress = progress
+}
+
+// SetSpeed updates the encoding speed
+func (s *SliceProgress) SetSpeed(speed float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Speed = speed
+}
+
+// MarshalJSON serializes the progress while it may be updated by its encode
+func (s *SliceProgress) MarshalJSON() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return json.Marshal(struct {
+		Slice    int
+		Active   bool
+		Done     bool
+		Position time.Duration
+		Speed    float64
+		Progress float64
+	}{s.Slice, s.Active, s.Done, s.Position, s.Speed, s.Progress})
+}
+
+// Shares is the result of the last reachability check of the locations avior reads from and writes to
+type Shares struct {
+	Checked   time.Time
+	Reachable bool
+	Locations []*ShareStatus
+}
+
+// ShareStatus is the reachability of a single location
+type ShareStatus struct {
+	Path string
+	// Kind is one of the consts.SHARE_KIND_* values
+	Kind      string
+	Reachable bool
+	Error     string `json:",omitempty"`
+	// Since is the time the location became reachable or unreachable
+	Since time.Time
+}
+
+// Janitor is the result of the last retention pass
+type Janitor struct {
+	Active  bool
+	LastRun time.Time
+	DryRun  bool
+	// Deleted and Freed count the files that have been deleted, or would have been in a dry run
+	Deleted int
+	Freed   int64
+	Errors  int
+}
+
 type FileWalker struct {
-	Active    bool
+	Active bool
+	// Directory is the source of the scan, media paths report their progress in Paths
 	Directory string
 	Position  int
 	LibSize   int
+	Paths     []*PathProgress
+}
+
+// PathProgress is the progress of a media path that is walked for duplicates
+type PathProgress struct {
+	Path     string
+	Active   bool
+	Done     bool
+	TimedOut bool
+	Position int
 }
 
 type Mover struct {
@@ -3,6 +3,7 @@ module github.com/Spiritreader/avior-go
 go 1.20
 
 require (
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.5.0
@@ -12,6 +13,7 @@ require (
 	github.com/natefinch/lumberjack v2.0.0+incompatible
 	github.com/redis/go-redis/v9 v9.0.4
 	github.com/rs/xid v1.5.0
+	go.etcd.io/bbolt v1.3.6
 	go.mongodb.org/mongo-driver v1.11.6
 	golang.org/x/sys v0.8.0
 )
@@ -0,0 +1,12 @@
+//go:build !windows && !linux
+
+package janitor
+
+import (
+	"errors"
+)
+
+// freeSpace is not supported on this platform, the minimum free space policy is skipped
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("free disk space is not supported on this platform")
+}
@@ -0,0 +1,284 @@
+package janitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/consts"
+	"github.com/Spiritreader/avior-go/db"
+	"github.com/Spiritreader/avior-go/globalstate"
+	"github.com/Spiritreader/avior-go/joblog"
+	"github.com/kpango/glg"
+)
+
+var state *globalstate.Data = globalstate.Instance()
+
+// protectMutex is held while files are deleted, so a job can't reference a file that is being deleted
+var protectMutex sync.Mutex
+var protected = make(map[string]bool)
+
+var trackMutex sync.Mutex
+var tracked *record
+
+// record are the directories files have been moved to and the time of each move,
+// moves keep the modification time so it can't tell how long a file has been there
+type record struct {
+	// Dirs maps a directory to its kind, consts.DONE_DIR, consts.EXIST_DIR or consts.OBSOLETE_DIR
+	Dirs  map[string]string
+	Moved map[string]time.Time
+}
+
+func recordPath() string {
+	return filepath.Join(globalstate.ReflectionPath(), "janitor.json")
+}
+
+// Run enforces the retention policies in the configured interval until ctx is done
+func Run(ctx context.Context) {
+	for {
+		settings := config.Instance().Local.Retention
+		if settings.Enabled {
+			clean(settings)
+		}
+		interval := settings.Interval
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Protect keeps files from being deleted until Release is called.
+//
+// All files that start with the name of a protected file are kept as well,
+// this covers its logs and copies that are renamed when they are moved
+func Protect(paths ...string) {
+	protectMutex.Lock()
+	defer protectMutex.Unlock()
+	for _, path := range paths {
+		protected[stem(path)] = true
+	}
+}
+
+// Release removes the protection of all files
+func Release() {
+	protectMutex.Lock()
+	defer protectMutex.Unlock()
+	protected = make(map[string]bool)
+}
+
+// isProtected has to be called with protectMutex held, remote are the protected stems of jobs of other clients
+func isProtected(path string, remote map[string]bool) bool {
+	name := strings.ToLower(filepath.Base(path))
+	for _, stems := range []map[string]bool{protected, remote} {
+		for prefix := range stems {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func stem(path string) string {
+	name := filepath.Base(path)
+	return strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+}
+
+// Track registers files that have been moved to a directory of kind, the directory is cleaned from now on
+func Track(kind string, paths ...string) {
+	if len(paths) == 0 {
+		return
+	}
+	trackMutex.Lock()
+	defer trackMutex.Unlock()
+	load()
+	now := time.Now()
+	for _, path := range paths {
+		tracked.Dirs[filepath.Dir(path)] = kind
+		tracked.Moved[path] = now
+	}
+	save()
+}
+
+// load reads the record once, has to be called with trackMutex held
+func load() {
+	if tracked != nil {
+		return
+	}
+	tracked = &record{Dirs: make(map[string]string), Moved: make(map[string]time.Time)}
+	bytes, err := os.ReadFile(recordPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err == nil {
+		err = json.Unmarshal(bytes, tracked)
+	}
+	if err != nil {
+		_ = glg.Warnf("janitor: could not read %s, tracking directories from scratch: %s", recordPath(), err)
+	}
+	if tracked.Dirs == nil {
+		tracked.Dirs = make(map[string]string)
+	}
+	if tracked.Moved == nil {
+		tracked.Moved = make(map[string]time.Time)
+	}
+}
+
+// save writes the record, has to be called with trackMutex held
+func save() {
+	bytes, err := json.MarshalIndent(tracked, "", "  ")
+	if err != nil {
+		_ = glg.Errorf("janitor: could not serialize tracked directories: %s", err)
+		return
+	}
+	if err := os.WriteFile(recordPath(), bytes, 0644); err != nil {
+		_ = glg.Errorf("janitor: could not write %s: %s", recordPath(), err)
+	}
+}
+
+// directories returns the directories to clean by kind and the move times of the tracked files.
+//
+// These are the obsolete directory of the config, the done and exists directories below roots
+// and next to the recordings in jobDirs, and all directories files have been moved to by this instance
+func directories(obsoletePath string, roots []string, jobDirs []string) (map[string][]string, map[string]time.Time) {
+	found := discover(roots, jobDirs)
+	trackMutex.Lock()
+	defer trackMutex.Unlock()
+	load()
+	changed := false
+	for dir, kind := range tracked.Dirs {
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+			delete(tracked.Dirs, dir)
+			changed = true
+			continue
+		}
+		found[dir] = kind
+	}
+	for path := range tracked.Moved {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			delete(tracked.Moved, path)
+			changed = true
+		}
+	}
+	if changed {
+		save()
+	}
+	if len(obsoletePath) > 0 {
+		found[filepath.Join(obsoletePath, consts.OBSOLETE_DIR)] = consts.OBSOLETE_DIR
+	}
+	dirs := make(map[string][]string)
+	for dir, kind := range found {
+		dirs[kind] = append(dirs[kind], dir)
+	}
+	moved := make(map[string]time.Time, len(tracked.Moved))
+	for path, movedAt := range tracked.Moved {
+		moved[path] = movedAt
+	}
+	return dirs, moved
+}
+
+// discover returns the done and exists directories below roots and next to the recordings in jobDirs
+func discover(roots []string, jobDirs []string) map[string]string {
+	kinds := map[string]string{consts.DONE_DIR: consts.DONE_DIR, consts.EXIST_DIR: consts.EXIST_DIR}
+	found := make(map[string]string)
+	for _, dir := range jobDirs {
+		// jobs that are processed again from an exists directory
+		if kind, ok := kinds[filepath.Base(dir)]; ok {
+			found[dir] = kind
+			dir = filepath.Dir(dir)
+		}
+		for name, kind := range kinds {
+			if info, err := os.Stat(filepath.Join(dir, name)); err == nil && info.IsDir() {
+				found[filepath.Join(dir, name)] = kind
+			}
+		}
+	}
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if path == root {
+					return err
+				}
+				_ = glg.Warnf("janitor: could not read %s: %s", path, err)
+				return nil
+			}
+			if !entry.IsDir() || path == root {
+				return nil
+			}
+			if strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if kind, ok := kinds[entry.Name()]; ok {
+				found[path] = kind
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			_ = glg.Warnf("janitor: could not search %s for done and exists directories: %s", root, err)
+		}
+	}
+	return found
+}
+
+// clean enforces the policies on all directories and reports the deleted files to log/janitor.log
+func clean(settings config.Retention) {
+	var jobDirs []string
+	remote := make(map[string]bool)
+	if dataStore := db.Get(); dataStore != nil {
+		var err error
+		if jobDirs, err = dataStore.GetJobDirectories(); err != nil {
+			_ = glg.Warnf("janitor: could not get job directories, only searching the roots: %s", err)
+		}
+		// the sources of jobs that other clients are processing are kept as well
+		jobs, err := dataStore.GetInFlightJobs()
+		if err != nil {
+			_ = glg.Warnf("janitor: could not get running jobs, skipping retention: %s", err)
+			return
+		}
+		for _, job := range jobs {
+			remote[stem(job.Path)] = true
+		}
+	}
+	dirs, moved := directories(config.Instance().Local.ObsoletePath, settings.Roots, jobDirs)
+	p := &pass{dryRun: settings.DryRun, now: time.Now(), moved: moved, remote: remote, report: new(joblog.Data), freeSpace: freeSpace}
+	state.Janitor.Active = true
+	defer func() { state.Janitor.Active = false }()
+	startTime := time.Now()
+	policies := map[string]config.RetentionPolicy{
+		consts.OBSOLETE_DIR: settings.Obsolete,
+		consts.DONE_DIR:     settings.Done,
+		consts.EXIST_DIR:    settings.Exists,
+	}
+	for kind, policy := range policies {
+		p.enforce(kind, dirs[kind], policy)
+	}
+	state.Janitor = globalstate.Janitor{
+		LastRun: startTime,
+		DryRun:  p.dryRun,
+		Deleted: p.deleted,
+		Freed:   p.freed,
+		Errors:  p.errors,
+	}
+	verb := "deleted"
+	if p.dryRun {
+		verb = "would have deleted"
+	}
+	_ = glg.Infof("janitor: %s %d files (%d bytes) in %s, %d errors", verb, p.deleted, p.freed, time.Since(startTime), p.errors)
+	if p.deleted > 0 || p.errors > 0 {
+		p.report.Add(fmt.Sprintf("Summary: %s %d files (%d bytes), %d errors", verb, p.deleted, p.freed, p.errors))
+		_ = p.report.AppendTo(filepath.Join(globalstate.ReflectionPath(), "log", "janitor.log"), false, true)
+	}
+}
@@ -0,0 +1,41 @@
+package janitor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Spiritreader/avior-go/consts"
+)
+
+func TestDiscover(t *testing.T) {
+	root := t.TempDir()
+	recordings := t.TempDir()
+	for _, dir := range []string{
+		filepath.Join(root, "a", consts.DONE_DIR),
+		filepath.Join(root, "b", "c", consts.EXIST_DIR),
+		filepath.Join(root, ".hidden", consts.DONE_DIR),
+		filepath.Join(recordings, consts.DONE_DIR),
+		filepath.Join(recordings, consts.EXIST_DIR),
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// jobs in an exists directory find the directories next to it as well
+	found := discover([]string{root}, []string{filepath.Join(recordings, consts.EXIST_DIR)})
+	expected := map[string]string{
+		filepath.Join(root, "a", consts.DONE_DIR):       consts.DONE_DIR,
+		filepath.Join(root, "b", "c", consts.EXIST_DIR): consts.EXIST_DIR,
+		filepath.Join(recordings, consts.DONE_DIR):      consts.DONE_DIR,
+		filepath.Join(recordings, consts.EXIST_DIR):     consts.EXIST_DIR,
+	}
+	if len(found) != len(expected) {
+		t.Errorf("expected %d directories, got %v", len(expected), found)
+	}
+	for dir, kind := range expected {
+		if found[dir] != kind {
+			t.Errorf("expected %s to be found as %s, got %q", dir, kind, found[dir])
+		}
+	}
+}
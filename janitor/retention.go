@@ -0,0 +1,174 @@
+package janitor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/joblog"
+	"github.com/kpango/glg"
+)
+
+const gigabyte = 1024 * 1024 * 1024
+
+// pass is a single run over all directories
+type pass struct {
+	dryRun    bool
+	now       time.Time
+	moved     map[string]time.Time
+	remote    map[string]bool
+	report    *joblog.Data
+	freeSpace func(dir string) (uint64, error)
+	deleted   int
+	freed     int64
+	errors    int
+}
+
+// entry is a file in a cleaned directory
+type entry struct {
+	path string
+	dir  string
+	size int64
+	// age is the time the file has been modified or moved to the directory, whatever is later
+	age     time.Time
+	deleted bool
+}
+
+// enforce deletes the oldest files of dirs until policy is met.
+//
+// Files older than the maximum age go first, then the oldest files until the total size is
+// below the maximum and at last the oldest files of each directory until its drive has enough free space
+func (p *pass) enforce(kind string, dirs []string, policy config.RetentionPolicy) {
+	if policy.MaxAge <= 0 && policy.MaxSize <= 0 && policy.MinFreeSpace <= 0 {
+		return
+	}
+	entries := p.list(dirs)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].age.Before(entries[j].age) })
+
+	if policy.MaxAge > 0 {
+		threshold := p.now.AddDate(0, 0, -policy.MaxAge)
+		for _, e := range entries {
+			if e.age.Before(threshold) {
+				p.delete(e, fmt.Sprintf("%s file older than %d days", kind, policy.MaxAge))
+			}
+		}
+	}
+
+	if policy.MaxSize > 0 {
+		var total int64
+		for _, e := range entries {
+			if !e.deleted {
+				total += e.size
+			}
+		}
+		maxSize := int64(policy.MaxSize * gigabyte)
+		for _, e := range entries {
+			if total <= maxSize {
+				break
+			}
+			if !e.deleted && p.delete(e, fmt.Sprintf("%s directories larger than %.1f GB", kind, policy.MaxSize)) {
+				total -= e.size
+			}
+		}
+	}
+
+	if policy.MinFreeSpace > 0 {
+		minFree := int64(policy.MinFreeSpace * gigabyte)
+		for _, dir := range dirs {
+			available, err := p.freeSpace(dir)
+			if err != nil {
+				_ = glg.Warnf("janitor: could not get free space of %s: %s", dir, err)
+				continue
+			}
+			// track the freed space, dry runs and network shares don't report it right away
+			free := int64(available)
+			for _, e := range entries {
+				if free >= minFree {
+					break
+				}
+				if e.dir == dir && !e.deleted && p.delete(e, fmt.Sprintf("less than %.1f GB free", policy.MinFreeSpace)) {
+					free += e.size
+				}
+			}
+		}
+	}
+}
+
+// list returns the files of dirs, hidden files and subdirectories are left alone
+func (p *pass) list(dirs []string) []*entry {
+	entries := make([]*entry, 0)
+	for _, dir := range dirs {
+		dirEntries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			_ = glg.Warnf("janitor: could not read %s: %s", dir, err)
+			p.errors++
+			continue
+		}
+		for _, dirEntry := range dirEntries {
+			if dirEntry.IsDir() || strings.HasPrefix(dirEntry.Name(), ".") {
+				continue
+			}
+			info, err := dirEntry.Info()
+			if err != nil {
+				continue
+			}
+			path := filepath.Join(dir, dirEntry.Name())
+			age := info.ModTime()
+			if movedAt, ok := p.moved[path]; ok && movedAt.After(age) {
+				age = movedAt
+			}
+			if movedAt, ok := moveTime(dirEntry.Name()); ok && movedAt.After(age) {
+				age = movedAt
+			}
+			entries = append(entries, &entry{path: path, dir: dir, size: info.Size(), age: age})
+		}
+	}
+	return entries
+}
+
+// moveTimePattern matches the time duplicates are named with when they are moved to the obsolete directory
+var moveTimePattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2} \d{4}$`)
+
+// moveTime returns the time a duplicate has been moved to the obsolete directory by any client
+func moveTime(name string) (time.Time, bool) {
+	match := moveTimePattern.FindString(strings.TrimSuffix(name, filepath.Ext(name)))
+	if len(match) == 0 {
+		return time.Time{}, false
+	}
+	movedAt, err := time.ParseInLocation("2006-01-02 1504", match, time.Local)
+	return movedAt, err == nil
+}
+
+// delete deletes a file unless a job has referenced it, returns true if the file is gone or would be in a dry run
+func (p *pass) delete(e *entry, reason string) bool {
+	protectMutex.Lock()
+	defer protectMutex.Unlock()
+	if isProtected(e.path, p.remote) {
+		_ = glg.Debugf("janitor: keeping %s, it is referenced by the running job", e.path)
+		return false
+	}
+	if p.dryRun {
+		p.report.Add(fmt.Sprintf("Would delete: %s (%s)", e.path, reason))
+	} else {
+		if err := os.Remove(e.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			_ = glg.Errorf("janitor: could not delete %s: %s", e.path, err)
+			p.report.Add(fmt.Sprintf("Error: %s could not be deleted: %s", e.path, err))
+			p.errors++
+			return false
+		}
+		_ = glg.Infof("janitor: deleted %s (%s)", e.path, reason)
+		p.report.Add(fmt.Sprintf("Deleted: %s (%s)", e.path, reason))
+	}
+	e.deleted = true
+	p.deleted++
+	p.freed += e.size
+	return true
+}
@@ -0,0 +1,80 @@
+package janitor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/consts"
+	"github.com/Spiritreader/avior-go/joblog"
+)
+
+func TestEnforce(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	write := func(name string, size int, age time.Duration) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := now.Add(-age)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	day := 24 * time.Hour
+	expired := write("Der Pate.mkv", 10, 40*day)
+	referenced := write("Tatort.mkv", 10, 50*day)
+	referencedLog := write("Tatort.INFO.log", 10, 50*day)
+	oldest := write("Polizeiruf 110.mkv", 30, 20*day)
+	newest := write("Terra X.mkv", 30, day)
+	// moved files keep their modification time, the move time counts
+	moved := write("Die Sendung mit der Maus.mkv", 10, 60*day)
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	newPass := func(dryRun bool) *pass {
+		return &pass{
+			dryRun: dryRun,
+			now:    now,
+			moved:  map[string]time.Time{moved: now},
+			report: new(joblog.Data),
+			freeSpace: func(string) (uint64, error) {
+				return 0, nil
+			},
+		}
+	}
+	Protect(filepath.Join("recordings", "Tatort.mkv"))
+	defer Release()
+	policy := config.RetentionPolicy{MaxAge: 30, MaxSize: 60.0 / gigabyte}
+
+	p := newPass(true)
+	p.enforce(consts.OBSOLETE_DIR, []string{dir}, policy)
+	if p.deleted != 2 || !exists(expired) || !exists(oldest) {
+		t.Errorf("dry run should report 2 files and delete none, reported %d", p.deleted)
+	}
+
+	p = newPass(false)
+	p.enforce(consts.OBSOLETE_DIR, []string{dir}, policy)
+	if exists(expired) || exists(oldest) {
+		t.Errorf("expected the expired and the oldest file to be deleted")
+	}
+	if !exists(referenced) || !exists(referencedLog) {
+		t.Errorf("files referenced by a job must not be deleted")
+	}
+	if !exists(newest) || !exists(moved) {
+		t.Errorf("expected the newest and the recently moved file to be kept")
+	}
+
+	// an empty drive deletes all files that aren't referenced
+	p = newPass(false)
+	p.enforce(consts.OBSOLETE_DIR, []string{dir}, config.RetentionPolicy{MinFreeSpace: 1})
+	if exists(newest) || exists(moved) || !exists(referenced) {
+		t.Errorf("expected all unreferenced files to be deleted to free space")
+	}
+}
@@ -0,0 +1,497 @@
+package library
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Spiritreader/avior-go/media"
+	"github.com/kpango/glg"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketDirs   = []byte("dirs")
+	bucketNames  = []byte("names")
+	bucketEvents = []byte("events")
+	bucketMeta   = []byte("meta")
+	keyExt       = []byte("ext")
+	keyRoots     = []byte("roots")
+)
+
+// dirEntry is the indexed content of a directory
+type dirEntry struct {
+	// ModTime is the modification time of the directory when it was last listed
+	ModTime int64
+	Dirs    []string
+	// Files maps the media files to their EPG event ids
+	Files map[string]string
+}
+
+// Index is a persistent index of the media files below the media paths.
+//
+// Files are looked up by their normalized name or by the EPG event id of their metadata logs
+type Index struct {
+	db    *bolt.DB
+	ext   string
+	mutex sync.Mutex
+}
+
+// Open opens or creates the index at path for media files with the extension ext.
+//
+// An index that has been built for a different extension is cleared
+func Open(path string, ext string) (*Index, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		if string(meta.Get(keyExt)) != ext {
+			for _, bucket := range [][]byte{bucketDirs, bucketNames, bucketEvents} {
+				if err := tx.DeleteBucket(bucket); err != nil && err != bolt.ErrBucketNotFound {
+					return err
+				}
+			}
+			if err := meta.Delete(keyRoots); err != nil {
+				return err
+			}
+		}
+		for _, bucket := range [][]byte{bucketDirs, bucketNames, bucketEvents} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return meta.Put(keyExt, []byte(ext))
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Index{db: db, ext: ext}, nil
+}
+
+// Close closes the index database
+func (i *Index) Close() error {
+	return i.db.Close()
+}
+
+// Ready returns true once a rescan of exactly these roots has completed
+func (i *Index) Ready(roots []string) bool {
+	var stored []string
+	_ = i.db.View(func(tx *bolt.Tx) error {
+		return json.Unmarshal(tx.Bucket(bucketMeta).Get(keyRoots), &stored)
+	})
+	return equalRoots(stored, roots)
+}
+
+// Lookup returns the paths of the files with the normalized name
+func (i *Index) Lookup(name string) []string {
+	return i.get(bucketNames, name)
+}
+
+// LookupEvent returns the paths of the files whose metadata logs have the EPG event id
+func (i *Index) LookupEvent(id string) []string {
+	return i.get(bucketEvents, id)
+}
+
+// Paths returns the paths of all indexed files
+func (i *Index) Paths() []string {
+	paths := make([]string, 0)
+	_ = i.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketNames).ForEach(func(_, value []byte) error {
+			var list []string
+			if err := json.Unmarshal(value, &list); err != nil {
+				return err
+			}
+			paths = append(paths, list...)
+			return nil
+		})
+	})
+	return paths
+}
+
+// Dirs returns all indexed directories
+func (i *Index) Dirs() []string {
+	dirs := make([]string, 0)
+	_ = i.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDirs).ForEach(func(key, _ []byte) error {
+			dirs = append(dirs, string(key))
+			return nil
+		})
+	})
+	return dirs
+}
+
+// Add indexes a single media file, other files are ignored
+func (i *Index) Add(path string) error {
+	if !strings.HasSuffix(path, i.ext) {
+		return nil
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	eventID := media.EventID(path)
+	return i.db.Update(func(tx *bolt.Tx) error {
+		dir, file := filepath.Split(path)
+		dir = filepath.Clean(dir)
+		entry, err := getDir(tx, dir)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			// the directory is listed on the next rescan
+			entry = &dirEntry{Files: make(map[string]string)}
+		}
+		if previous, ok := entry.Files[file]; ok {
+			if err := i.removeFile(tx, dir, file, previous); err != nil {
+				return err
+			}
+		}
+		entry.Files[file] = eventID
+		if err := i.addFile(tx, dir, file, eventID); err != nil {
+			return err
+		}
+		return putDir(tx, dir, entry)
+	})
+}
+
+// Remove removes a media file or a directory with all of its content from the index
+func (i *Index) Remove(path string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.db.Update(func(tx *bolt.Tx) error {
+		parentPath, name := filepath.Split(path)
+		parentPath = filepath.Clean(parentPath)
+		parent, err := getDir(tx, parentPath)
+		if err != nil {
+			return err
+		}
+		if parent != nil {
+			if eventID, ok := parent.Files[name]; ok {
+				delete(parent.Files, name)
+				if err := i.removeFile(tx, parentPath, name, eventID); err != nil {
+					return err
+				}
+			}
+			parent.Dirs = without(parent.Dirs, name)
+			if err := putDir(tx, parentPath, parent); err != nil {
+				return err
+			}
+		}
+		return i.removeDir(tx, path)
+	})
+}
+
+// Rescan lists all directories below the roots whose modification time changed since they were last listed.
+//
+// Directories that can't be read keep their indexed content. The rescan is aborted if a root can't be read
+func (i *Index) Rescan(ctx context.Context, roots []string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	seen := make(map[string]bool)
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		if _, err := os.Stat(root); err != nil {
+			return err
+		}
+		if err := i.rescanDir(ctx, root, seen); err != nil {
+			return err
+		}
+	}
+	// directories that have not been seen belong to roots that are no longer configured
+	for _, dir := range i.Dirs() {
+		if seen[dir] {
+			continue
+		}
+		if err := i.db.Update(func(tx *bolt.Tx) error { return i.removeDir(tx, dir) }); err != nil {
+			return err
+		}
+	}
+	return i.db.Update(func(tx *bolt.Tx) error {
+		value, err := json.Marshal(roots)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketMeta).Put(keyRoots, value)
+	})
+}
+
+// AddDir indexes a new directory below the roots with its subdirectories and returns the directories it listed
+func (i *Index) AddDir(ctx context.Context, dir string) ([]string, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	dir = filepath.Clean(dir)
+	parentPath, name := filepath.Split(dir)
+	parentPath = filepath.Clean(parentPath)
+	err := i.db.Update(func(tx *bolt.Tx) error {
+		parent, err := getDir(tx, parentPath)
+		if err != nil || parent == nil || contains(parent.Dirs, name) {
+			// directories outside of the index are picked up by the next rescan
+			return err
+		}
+		parent.Dirs = append(parent.Dirs, name)
+		return putDir(tx, parentPath, parent)
+	})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	if err := i.rescanDir(ctx, dir, seen); err != nil {
+		return nil, err
+	}
+	dirs := make([]string, 0, len(seen))
+	for listed := range seen {
+		dirs = append(dirs, listed)
+	}
+	return dirs, nil
+}
+
+// rescanDir lists dir if it has changed and descends into its subdirectories
+func (i *Index) rescanDir(ctx context.Context, dir string, seen map[string]bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	seen[dir] = true
+	var entry *dirEntry
+	err := i.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entry, err = getDir(tx, dir)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return i.db.Update(func(tx *bolt.Tx) error { return i.removeDir(tx, dir) })
+	}
+	if err == nil && (entry == nil || entry.ModTime != info.ModTime().UnixNano()) {
+		entry, err = i.list(dir, info.ModTime().UnixNano(), entry)
+	}
+	if err != nil {
+		_ = glg.Warnf("library: could not read %s, keeping indexed content: %s", dir, err)
+		i.markSeen(dir, seen)
+		return nil
+	}
+	for _, child := range entry.Dirs {
+		if err := i.rescanDir(ctx, filepath.Join(dir, child), seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list reads the content of dir and updates the index with the difference to the previous entry
+func (i *Index) list(dir string, modTime int64, previous *dirEntry) (*dirEntry, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entry := &dirEntry{ModTime: modTime, Dirs: make([]string, 0), Files: make(map[string]string)}
+	names := make(map[string]bool)
+	for _, de := range dirEntries {
+		names[de.Name()] = true
+	}
+	for _, de := range dirEntries {
+		if de.IsDir() {
+			if !strings.HasPrefix(de.Name(), ".") {
+				entry.Dirs = append(entry.Dirs, de.Name())
+			}
+		} else if strings.HasSuffix(de.Name(), i.ext) {
+			entry.Files[de.Name()] = ""
+			if names[strings.TrimSuffix(de.Name(), i.ext)+".txt"] {
+				entry.Files[de.Name()] = media.EventID(filepath.Join(dir, de.Name()))
+			}
+		}
+	}
+	if previous == nil {
+		previous = &dirEntry{Files: make(map[string]string)}
+	}
+	err = i.db.Update(func(tx *bolt.Tx) error {
+		for file, eventID := range previous.Files {
+			if current, ok := entry.Files[file]; !ok || current != eventID {
+				if err := i.removeFile(tx, dir, file, eventID); err != nil {
+					return err
+				}
+			}
+		}
+		for file, eventID := range entry.Files {
+			if current, ok := previous.Files[file]; !ok || current != eventID {
+				if err := i.addFile(tx, dir, file, eventID); err != nil {
+					return err
+				}
+			}
+		}
+		for _, child := range previous.Dirs {
+			if !contains(entry.Dirs, child) {
+				if err := i.removeDir(tx, filepath.Join(dir, child)); err != nil {
+					return err
+				}
+			}
+		}
+		return putDir(tx, dir, entry)
+	})
+	return entry, err
+}
+
+// markSeen marks dir and all of its indexed subdirectories as seen
+func (i *Index) markSeen(dir string, seen map[string]bool) {
+	prefix := dir + string(filepath.Separator)
+	for _, indexed := range i.Dirs() {
+		if indexed == dir || strings.HasPrefix(indexed, prefix) {
+			seen[indexed] = true
+		}
+	}
+}
+
+// removeDir removes dir and its subdirectories with all of their files
+func (i *Index) removeDir(tx *bolt.Tx, dir string) error {
+	entry, err := getDir(tx, dir)
+	if err != nil || entry == nil {
+		return err
+	}
+	for file, eventID := range entry.Files {
+		if err := i.removeFile(tx, dir, file, eventID); err != nil {
+			return err
+		}
+	}
+	for _, child := range entry.Dirs {
+		if err := i.removeDir(tx, filepath.Join(dir, child)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(bucketDirs).Delete([]byte(dir))
+}
+
+func (i *Index) addFile(tx *bolt.Tx, dir string, file string, eventID string) error {
+	path := filepath.Join(dir, file)
+	if err := update(tx.Bucket(bucketNames), i.name(file), func(paths []string) []string {
+		return append(without(paths, path), path)
+	}); err != nil {
+		return err
+	}
+	if eventID == "" {
+		return nil
+	}
+	return update(tx.Bucket(bucketEvents), eventID, func(paths []string) []string {
+		return append(without(paths, path), path)
+	})
+}
+
+func (i *Index) removeFile(tx *bolt.Tx, dir string, file string, eventID string) error {
+	path := filepath.Join(dir, file)
+	if err := update(tx.Bucket(bucketNames), i.name(file), func(paths []string) []string {
+		return without(paths, path)
+	}); err != nil {
+		return err
+	}
+	if eventID == "" {
+		return nil
+	}
+	return update(tx.Bucket(bucketEvents), eventID, func(paths []string) []string {
+		return without(paths, path)
+	})
+}
+
+// name is the normalized name a file is looked up by
+func (i *Index) name(file string) string {
+	return media.Normalize(strings.TrimSuffix(file, i.ext))
+}
+
+func (i *Index) get(bucket []byte, key string) []string {
+	var paths []string
+	_ = i.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(bucket).Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+		return json.Unmarshal(value, &paths)
+	})
+	return paths
+}
+
+// update replaces the path list at key, empty lists are deleted
+func update(bucket *bolt.Bucket, key string, fn func([]string) []string) error {
+	var paths []string
+	if value := bucket.Get([]byte(key)); value != nil {
+		if err := json.Unmarshal(value, &paths); err != nil {
+			return err
+		}
+	}
+	paths = fn(paths)
+	if len(paths) == 0 {
+		return bucket.Delete([]byte(key))
+	}
+	value, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), value)
+}
+
+func getDir(tx *bolt.Tx, dir string) (*dirEntry, error) {
+	value := tx.Bucket(bucketDirs).Get([]byte(dir))
+	if value == nil {
+		return nil, nil
+	}
+	entry := new(dirEntry)
+	if err := json.Unmarshal(value, entry); err != nil {
+		return nil, errors.New("corrupt directory entry " + dir + ": " + err.Error())
+	}
+	if entry.Files == nil {
+		entry.Files = make(map[string]string)
+	}
+	return entry, nil
+}
+
+func putDir(tx *bolt.Tx, dir string, entry *dirEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketDirs).Put([]byte(dir), value)
+}
+
+func without(list []string, item string) []string {
+	out := make([]string, 0, len(list))
+	for _, value := range list {
+		if value != item {
+			out = append(out, value)
+		}
+	}
+	return out
+}
+
+func contains(list []string, item string) bool {
+	for _, value := range list {
+		if value == item {
+			return true
+		}
+	}
+	return false
+}
+
+func equalRoots(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for idx := range a {
+		if filepath.Clean(a[idx]) != filepath.Clean(b[idx]) {
+			return false
+		}
+	}
+	return true
+}
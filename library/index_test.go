@@ -0,0 +1,124 @@
+package library
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIndex(t *testing.T) {
+	root := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "library.db")
+	write := func(path string, content string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(root, "tv", "Tatort - Schöne neue Welt.mkv"), "")
+	write(filepath.Join(root, "tv", "Tatort - Schöne neue Welt.txt"), "EventID=4711\n")
+	write(filepath.Join(root, "movies", "Der Pate.mkv"), "")
+	write(filepath.Join(root, ".obsolete", "Der Pate.mkv"), "")
+
+	index, err := Open(dbPath, ".mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := []string{root}
+	if index.Ready(roots) {
+		t.Errorf("index is ready before the first rescan")
+	}
+	if err := index.Rescan(context.Background(), roots); err != nil {
+		t.Fatal(err)
+	}
+	if !index.Ready(roots) {
+		t.Errorf("index isn't ready after a rescan")
+	}
+	if paths := index.Lookup("der pate"); len(paths) != 1 || paths[0] != filepath.Join(root, "movies", "Der Pate.mkv") {
+		t.Errorf("expected the movie outside of hidden directories, got %v", paths)
+	}
+	if paths := index.LookupEvent("4711"); len(paths) != 1 {
+		t.Errorf("expected one file with event id 4711, got %v", paths)
+	}
+
+	// changed directories are listed again
+	write(filepath.Join(root, "movies", "Der Pate 2.mkv"), "")
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(root, "movies"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "tv")); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Rescan(context.Background(), roots); err != nil {
+		t.Fatal(err)
+	}
+	if paths := index.Lookup("der pate 2"); len(paths) != 1 {
+		t.Errorf("expected the new file to be indexed, got %v", paths)
+	}
+	if paths := index.LookupEvent("4711"); len(paths) != 0 {
+		t.Errorf("expected the removed directory to be dropped, got %v", paths)
+	}
+
+	if err := index.Remove(filepath.Join(root, "movies", "Der Pate 2.mkv")); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the index survives restarts
+	index, err = Open(dbPath, ".mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if !index.Ready(roots) {
+		t.Errorf("reopened index isn't ready")
+	}
+	if paths := index.Paths(); len(paths) != 1 {
+		t.Errorf("expected one indexed file after reopening, got %v", paths)
+	}
+}
+
+func TestIndexAddDir(t *testing.T) {
+	root := t.TempDir()
+	index, err := Open(filepath.Join(t.TempDir(), "library.db"), ".mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if err := index.Rescan(context.Background(), []string{root}); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the new directory and its subtree are listed
+	if err := os.MkdirAll(filepath.Join(root, "new", "season 1"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "new", "season 1", "Der Pate.mkv"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := index.AddDir(context.Background(), filepath.Join(root, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 2 {
+		t.Errorf("expected the new directory and its subdirectory, got %v", dirs)
+	}
+	if paths := index.Lookup("der pate"); len(paths) != 1 {
+		t.Errorf("expected the file in the new directory to be indexed, got %v", paths)
+	}
+
+	// the new directory is kept by the next rescan
+	if err := index.Rescan(context.Background(), []string{root}); err != nil {
+		t.Fatal(err)
+	}
+	if paths := index.Lookup("der pate"); len(paths) != 1 {
+		t.Errorf("expected the file to survive a rescan, got %v", paths)
+	}
+}
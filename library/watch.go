@@ -0,0 +1,224 @@
+package library
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/globalstate"
+	"github.com/Spiritreader/avior-go/redis"
+	"github.com/fsnotify/fsnotify"
+	"github.com/kpango/glg"
+)
+
+var mutex sync.Mutex
+var instance *service
+
+// service keeps a running index up to date
+type service struct {
+	index    *Index
+	settings config.LibraryIndex
+	roots    []string
+	ext      string
+	watcher  *fsnotify.Watcher
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// Get returns the running index, nil if the index is disabled
+func Get() *Index {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if instance == nil {
+		return nil
+	}
+	return instance.index
+}
+
+// AutoManage opens, reconfigures or closes the index based on the config
+func AutoManage() {
+	cfg := config.Instance()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if instance != nil && instance.settings == cfg.Local.LibraryIndex &&
+		instance.ext == cfg.Local.Ext && reflect.DeepEqual(instance.roots, cfg.Local.MediaPaths) {
+		return
+	}
+	if instance != nil {
+		_ = glg.Infof("library: config changed, restarting index")
+		instance.stop()
+		instance = nil
+	}
+	if !cfg.Local.LibraryIndex.Enabled {
+		return
+	}
+	index, err := Open(filepath.Join(globalstate.ReflectionPath(), "library.db"), cfg.Local.Ext)
+	if err != nil {
+		_ = glg.Errorf("library: could not open index, scanning media paths instead: %s", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	instance = &service{
+		index:    index,
+		settings: cfg.Local.LibraryIndex,
+		roots:    append([]string(nil), cfg.Local.MediaPaths...),
+		ext:      cfg.Local.Ext,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	if cfg.Local.LibraryIndex.Watch {
+		instance.watcher, err = fsnotify.NewWatcher()
+		if err != nil {
+			_ = glg.Warnf("library: could not start filesystem watch, relying on rescans: %s", err)
+		}
+	}
+	go instance.run()
+}
+
+// Close stops updating the index and closes it
+func Close() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if instance != nil {
+		instance.stop()
+		instance = nil
+	}
+}
+
+func (s *service) stop() {
+	s.cancel()
+	<-s.done
+	if s.watcher != nil {
+		_ = s.watcher.Close()
+	}
+	if err := s.index.Close(); err != nil {
+		_ = glg.Warnf("library: error closing index: %s", err)
+	}
+}
+
+// run rescans the roots periodically and applies filesystem notifications in between
+func (s *service) run() {
+	defer close(s.done)
+	interval := s.settings.RescanInterval
+	if interval <= 0 {
+		interval = 15 * time.Minute
+	}
+	var events chan fsnotify.Event
+	var errs chan error
+	if s.watcher != nil {
+		events = s.watcher.Events
+		errs = s.watcher.Errors
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+			s.rescan()
+			timer.Reset(interval)
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			s.handle(event)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			_ = glg.Warnf("library: filesystem watch error: %s", err)
+		}
+	}
+}
+
+func (s *service) rescan() {
+	startTime := time.Now()
+	if err := s.index.Rescan(s.ctx, s.roots); err != nil {
+		_ = glg.Warnf("library: rescan aborted, keeping index: %s", err)
+		return
+	}
+	_ = glg.Infof("library: rescan took %s", time.Since(startTime))
+	s.watch(s.index.Dirs())
+}
+
+// watch adds watches for dirs, adding a directory that is already watched has no effect
+func (s *service) watch(dirs []string) {
+	if s.watcher == nil {
+		return
+	}
+	failed := 0
+	for _, dir := range dirs {
+		if err := s.watcher.Add(dir); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		_ = glg.Warnf("library: could not watch %d of %d directories, relying on rescans for them", failed, len(dirs))
+	}
+}
+
+func (s *service) handle(event fsnotify.Event) {
+	if strings.HasPrefix(filepath.Base(event.Name), ".") {
+		return
+	}
+	var err error
+	switch {
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		err = s.index.Remove(event.Name)
+	case event.Op&fsnotify.Write != 0 && strings.HasSuffix(event.Name, ".txt"), event.Op&fsnotify.Create != 0:
+		info, statErr := os.Stat(event.Name)
+		if statErr != nil {
+			return
+		}
+		if info.IsDir() {
+			var dirs []string
+			if dirs, err = s.index.AddDir(s.ctx, event.Name); err == nil {
+				s.watch(dirs)
+			}
+		} else if strings.HasSuffix(event.Name, ".txt") {
+			// the event id of a file changes with its metadata log
+			mediaPath := strings.TrimSuffix(event.Name, ".txt") + s.ext
+			if _, statErr := os.Stat(mediaPath); statErr == nil {
+				err = s.index.Add(mediaPath)
+			}
+		} else {
+			err = s.index.Add(event.Name)
+		}
+	}
+	if err != nil {
+		_ = glg.Warnf("library: could not apply %s: %s", event, err)
+		return
+	}
+	s.share(event)
+}
+
+// share publishes changes of media files to the shared library if redis is enabled,
+// directory changes are picked up by the next full scan
+func (s *service) share(event fsnotify.Event) {
+	if !strings.HasSuffix(event.Name, s.ext) || event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+		return
+	}
+	handle := redis.Get().Handle
+	if !handle.Running() {
+		return
+	}
+	var err error
+	if event.Op&fsnotify.Create != 0 {
+		err = handle.AddPath(event.Name)
+	} else {
+		err = handle.RemovePath(event.Name)
+	}
+	if err != nil {
+		_ = glg.Warnf("library: could not share %s: %s", event, err)
+	}
+}
@@ -0,0 +1,164 @@
+package media
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/consts"
+)
+
+// Match is a duplicate found by a Matcher
+type Match struct {
+	File
+	// Strategy is the consts.MATCH_* strategy that found the duplicate
+	Strategy string
+	// Score is the similarity of the names from 0 to 1, strategies other than fuzzy always score 1
+	Score float64
+}
+
+// Matcher compares library paths with the output name of a file
+type Matcher struct {
+	settings   config.DuplicateMatching
+	ext        string
+	name       string
+	normalized string
+	eventID    string
+}
+
+// transliteration also covers umlauts decomposed into a vowel and a combining diaeresis
+var transliteration = strings.NewReplacer(
+	"ä", "ae", "ö", "oe", "ü", "ue", "ß", "ss",
+	"a\u0308", "ae", "o\u0308", "oe", "u\u0308", "ue")
+
+// NewMatcher creates a matcher for files with the extension ext that are duplicates of file
+func NewMatcher(file File, ext string, settings config.DuplicateMatching) *Matcher {
+	return &Matcher{
+		settings:   settings,
+		ext:        ext,
+		name:       file.OutName(),
+		normalized: Normalize(file.OutName()),
+		eventID:    file.Metadata("EventID"),
+	}
+}
+
+// Match checks if the file at path is a duplicate.
+//
+// Strategies are tried in the order exact, normalized, event id and fuzzy, the first one that hits is returned
+func (m *Matcher) Match(path string) (Match, bool) {
+	base := filepath.Base(path)
+	if !strings.HasSuffix(base, m.ext) {
+		return Match{}, false
+	}
+	name := strings.TrimSuffix(base, m.ext)
+	if name == m.name {
+		return Match{File: File{Path: path}, Strategy: consts.MATCH_EXACT, Score: 1}, true
+	}
+	normalized := Normalize(name)
+	if m.settings.Normalized && normalized == m.normalized {
+		return Match{File: File{Path: path}, Strategy: consts.MATCH_NORMALIZED, Score: 1}, true
+	}
+	if !m.settings.EventIDs && m.settings.FuzzyThreshold <= 0 {
+		return Match{}, false
+	}
+	score := Similarity(normalized, m.normalized)
+	if m.settings.EventIDs && m.eventID != "" && score >= m.settings.EventIDMinSimilarity {
+		if EventID(path) == m.eventID {
+			return Match{File: File{Path: path}, Strategy: consts.MATCH_EVENT_ID, Score: 1}, true
+		}
+	}
+	if m.settings.FuzzyThreshold > 0 && score >= m.settings.FuzzyThreshold {
+		return Match{File: File{Path: path}, Strategy: consts.MATCH_FUZZY, Score: score}, true
+	}
+	return Match{}, false
+}
+
+// Name is the normalized output name, exact and normalized matches share it
+func (m *Matcher) Name() string {
+	return m.normalized
+}
+
+// EventID is the EPG event id that is matched against, it is empty if event id matching is disabled
+func (m *Matcher) EventID() string {
+	if !m.settings.EventIDs {
+		return ""
+	}
+	return m.eventID
+}
+
+// Exhaustive is true if fuzzy matching is enabled, which needs every path to be matched
+func (m *Matcher) Exhaustive() bool {
+	return m.settings.FuzzyThreshold > 0
+}
+
+// EventID reads the EPG event id from the metadata log next to the file at path
+func EventID(path string) string {
+	file := File{Path: path}
+	stem := strings.TrimSuffix(path, filepath.Ext(path))
+	if err := readFileContent(&file.MetadataLog, stem+".txt"); err != nil {
+		return ""
+	}
+	return file.Metadata("EventID")
+}
+
+// SortMatches orders matches by the reliability of their strategy and then by score
+func SortMatches(matches []Match) {
+	rank := map[string]int{
+		consts.MATCH_EXACT:      0,
+		consts.MATCH_NORMALIZED: 1,
+		consts.MATCH_EVENT_ID:   2,
+		consts.MATCH_FUZZY:      3,
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if rank[matches[i].Strategy] != rank[matches[j].Strategy] {
+			return rank[matches[i].Strategy] < rank[matches[j].Strategy]
+		}
+		return matches[i].Score > matches[j].Score
+	})
+}
+
+// Normalize lowercases a name, transliterates umlauts and replaces punctuation with single spaces
+func Normalize(name string) string {
+	name = transliteration.Replace(strings.ToLower(name))
+	return strings.Join(strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// Similarity is the levenshtein distance of a and b relative to the longer string, 1 means equal
+func Similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+	row := make([]int, len(rb)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			next := diagonal + cost
+			if row[j]+1 < next {
+				next = row[j] + 1
+			}
+			if row[j-1]+1 < next {
+				next = row[j-1] + 1
+			}
+			diagonal = row[j]
+			row[j] = next
+		}
+	}
+	return 1 - float64(row[len(rb)])/float64(longest)
+}
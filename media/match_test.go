@@ -0,0 +1,61 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/consts"
+)
+
+func TestMatcher(t *testing.T) {
+	dir := t.TempDir()
+	eventPath := filepath.Join(dir, "Tatort - Schöne Neue Welt (Wdh.).mkv")
+	if err := os.WriteFile(filepath.Join(dir, "Tatort - Schöne Neue Welt (Wdh.).txt"), []byte("EventID=4711\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := File{
+		Name:        "Tatort",
+		Subtitle:    "Schöne neue Welt",
+		MetadataLog: []string{"EventID = 4711"},
+	}
+	settings := config.DuplicateMatching{Normalized: true, EventIDs: true, EventIDMinSimilarity: 0.5, FuzzyThreshold: 0.9}
+	matcher := NewMatcher(file, ".mkv", settings)
+
+	tests := []struct {
+		path     string
+		strategy string
+	}{
+		{filepath.Join(dir, "Tatort - Schöne neue Welt.mkv"), consts.MATCH_EXACT},
+		{filepath.Join(dir, "tatort_schoene_neue_welt.mkv"), consts.MATCH_NORMALIZED},
+		{eventPath, consts.MATCH_EVENT_ID},
+		{filepath.Join(dir, "Tatort - Schöne neue Welten.mkv"), consts.MATCH_FUZZY},
+		{filepath.Join(dir, "Tatort - Schöne neue Welt.ts"), ""},
+		{filepath.Join(dir, "Polizeiruf 110 - Schöne neue Welt.mkv"), ""},
+	}
+	for _, test := range tests {
+		match, ok := matcher.Match(test.path)
+		if ok != (test.strategy != "") || match.Strategy != test.strategy {
+			t.Errorf("%s: got %s (%t), expected %s", test.path, match.Strategy, ok, test.strategy)
+		}
+		if ok && (match.Score <= 0 || match.Score > 1) {
+			t.Errorf("%s: score %f out of range", test.path, match.Score)
+		}
+	}
+
+	settings.EventIDs = false
+	settings.FuzzyThreshold = 0
+	if _, ok := NewMatcher(file, ".mkv", settings).Match(eventPath); ok {
+		t.Errorf("%s matched with event ids and fuzzy matching disabled", eventPath)
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	if s := Similarity("kitten", "sitting"); s < 0.57 || s > 0.58 {
+		t.Errorf("expected 1 - 3/7, got %f", s)
+	}
+	if s := Similarity("", ""); s != 1 {
+		t.Errorf("expected empty strings to be equal, got %f", s)
+	}
+}
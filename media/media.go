@@ -122,7 +122,9 @@ type File struct {
 	TunerLog         []string
 	LogPaths         []string
 	AllowReplacement bool
-	legacy           bool
+	// Tags are the container tags read by ReadTags
+	Tags   map[string]string
+	legacy bool
 }
 
 // Updates the struct to fill out all remaining fields
@@ -491,3 +493,46 @@ func readFileContent(out *[]string, filePath string) error {
 	}
 	return nil
 }
+
+// Metadata returns the value of the first key=value line with the given key in the metadata log
+func (f *File) Metadata(key string) string {
+	for _, line := range f.MetadataLog {
+		lineKey, value, found := strings.Cut(line, "=")
+		if found && strings.EqualFold(strings.TrimSpace(lineKey), key) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// ReadTags fills the fields that are unknown without logs from the tags avior embeds into encodes
+//
+// It is meant for files whose logs are missing, fields that have already been read from logs are kept
+func (f *File) ReadTags() error {
+	info, err := tools.FfProbeInfo(f.Path)
+	if err != nil {
+		return err
+	}
+	f.applyTags(info.Tags)
+	return nil
+}
+
+func (f *File) applyTags(tags map[string]string) {
+	f.Tags = tags
+	readInt := func(key string, field *int) {
+		if value, err := strconv.Atoi(tags[key]); err == nil && *field <= 0 {
+			*field = value
+		}
+	}
+	readInt(consts.TAG_RECORDED_LENGTH, &f.RecordedLength)
+	readInt(consts.TAG_LENGTH, &f.Length)
+	if value, err := strconv.Atoi(tags[consts.TAG_ERRORS]); err == nil && f.Errors <= 0 {
+		f.Errors = value
+	}
+	if value, err := strconv.Atoi(tags[consts.TAG_AUDIO_FORMAT]); err == nil && f.AudioFormat == AUDIO_UNKNOWN {
+		f.AudioFormat = AudioFormat(value)
+	}
+	if tag, value, found := strings.Cut(tags[consts.TAG_RESOLUTION], ":"); found && len(f.Resolution.Tag) == 0 {
+		f.Resolution = Resolution{Tag: tag, Value: value}
+	}
+}
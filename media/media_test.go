@@ -23,3 +23,20 @@ func TestAudioParsing (t *testing.T) {
 	testFile := &File{Path: `\\UMS\recording_pool\Manual\Thomas Hengelbrock dirigiert Ravel und Franck.mkv`}
 	testFile.Update()
 }
+
+func TestApplyTags(t *testing.T) {
+	file := &File{RecordedLength: -1, Length: -1, Errors: -1}
+	file.applyTags(map[string]string{
+		consts.TAG_RECORDED_LENGTH: "95",
+		consts.TAG_LENGTH:          "90",
+		consts.TAG_ERRORS:          "2",
+		consts.TAG_AUDIO_FORMAT:    "3",
+		consts.TAG_RESOLUTION:      "fhd:1920x1080",
+	})
+	if file.RecordedLength != 95 || file.Length != 90 || file.Errors != 2 || file.AudioFormat != MULTI {
+		t.Errorf("unexpected fields from tags: %+v", file)
+	}
+	if file.Resolution.Tag != "fhd" || file.Resolution.Value != "1920x1080" {
+		t.Errorf("unexpected resolution from tags: %+v", file.Resolution)
+	}
+}
@@ -0,0 +1,165 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/Spiritreader/avior-go/cache"
+	"github.com/Spiritreader/avior-go/consts"
+	"github.com/kpango/glg"
+	"github.com/redis/go-redis/v9"
+)
+
+// LibraryMessage is a change of the shared library that is broadcast to all clients
+type LibraryMessage struct {
+	Type string
+	Path string
+	// From is the previous path of a moved file
+	From string `json:",omitempty"`
+	// Sender identifies the client, snapshots are not reloaded by their sender
+	Sender string `json:",omitempty"`
+}
+
+func (r *Handle) libraryKey() string {
+	return r.cfg.Local.Redis.ChannelPrefix + "-library"
+}
+
+func (r *Handle) libraryUpdatedKey() string {
+	return r.cfg.Local.Redis.ChannelPrefix + "-library-updated"
+}
+
+func (r *Handle) libraryChannel() string {
+	return r.cfg.Local.Redis.ChannelPrefix + "-library-events"
+}
+
+// AddPath adds a file to the shared library
+func (r *Handle) AddPath(path string) error {
+	return r.publishLibrary(LibraryMessage{Type: consts.LIBRARY_ADD, Path: path}, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.SAdd(ctx, r.libraryKey(), path)
+	})
+}
+
+// RemovePath removes a file from the shared library
+func (r *Handle) RemovePath(path string) error {
+	return r.publishLibrary(LibraryMessage{Type: consts.LIBRARY_REMOVE, Path: path}, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.SRem(ctx, r.libraryKey(), path)
+	})
+}
+
+// MovePath moves a file in the shared library, files moved out of the library like to .obsolete are removed
+func (r *Handle) MovePath(from string, to string) error {
+	return r.publishLibrary(LibraryMessage{Type: consts.LIBRARY_MOVE, Path: to, From: from}, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.SRem(ctx, r.libraryKey(), from)
+		if cache.InLibrary(to) {
+			pipe.SAdd(ctx, r.libraryKey(), to)
+		}
+	})
+}
+
+// ReplaceLibrary replaces the shared library with the result of a full scan and tells all clients to reload it
+func (r *Handle) ReplaceLibrary(paths []string) error {
+	if r.client == nil {
+		return RedisNotInitialized
+	}
+	payload, err := json.Marshal(LibraryMessage{Type: consts.LIBRARY_SNAPSHOT, Sender: r.id})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.libraryKey())
+		for start := 0; start < len(paths); start += 1000 {
+			end := start + 1000
+			if end > len(paths) {
+				end = len(paths)
+			}
+			members := make([]interface{}, end-start)
+			for idx, path := range paths[start:end] {
+				members[idx] = path
+			}
+			pipe.SAdd(ctx, r.libraryKey(), members...)
+		}
+		pipe.Set(ctx, r.libraryUpdatedKey(), time.Now().Format(time.RFC3339Nano), 0)
+		pipe.Publish(ctx, r.libraryChannel(), payload)
+		return nil
+	})
+	return err
+}
+
+func (r *Handle) publishLibrary(msg LibraryMessage, op func(ctx context.Context, pipe redis.Pipeliner)) error {
+	if r.client == nil {
+		return RedisNotInitialized
+	}
+	msg.Sender = r.id
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		op(ctx, pipe)
+		pipe.Publish(ctx, r.libraryChannel(), payload)
+		return nil
+	})
+	return err
+}
+
+// loadLibrary replaces the library cache with the shared library.
+//
+// The cache stays invalid if no client has published a full scan yet
+func (r *Handle) loadLibrary() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	updated, err := r.client.Get(ctx, r.libraryUpdatedKey()).Result()
+	if err == redis.Nil {
+		glg.Infof("redis: no shared library yet")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	lastUpdate, err := time.Parse(time.RFC3339Nano, updated)
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0)
+	iter := r.client.SScan(ctx, r.libraryKey(), 0, "", 1000).Iterator()
+	for iter.Next(ctx) {
+		paths = append(paths, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	cache.Instance().Library.Replace(paths, lastUpdate)
+	glg.Infof("redis: loaded %d library paths from the scan of %s", len(paths), lastUpdate.Format(time.RFC3339))
+	return nil
+}
+
+// applyLibrary applies a library message to the library cache
+func (r *Handle) applyLibrary(payload string) {
+	msg := LibraryMessage{}
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		glg.Warnf("redis: invalid library message %s: %s", payload, err)
+		return
+	}
+	library := &cache.Instance().Library
+	switch msg.Type {
+	case consts.LIBRARY_ADD:
+		library.Add(msg.Path)
+	case consts.LIBRARY_REMOVE:
+		library.Remove(msg.Path)
+	case consts.LIBRARY_MOVE:
+		library.Move(msg.From, msg.Path)
+	case consts.LIBRARY_SNAPSHOT:
+		if msg.Sender == r.id {
+			return
+		}
+		if err := r.loadLibrary(); err != nil {
+			glg.Warnf("redis: could not reload shared library: %s", err)
+		}
+	default:
+		glg.Warnf("redis: unknown library message type %s", msg.Type)
+	}
+}
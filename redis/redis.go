@@ -11,6 +11,7 @@ import (
 	"github.com/Spiritreader/avior-go/config"
 	"github.com/kpango/glg"
 	"github.com/redis/go-redis/v9"
+	"github.com/rs/xid"
 )
 
 var RedisNotInitialized error = errors.New("redis client not initialized")
@@ -30,6 +31,8 @@ type Handle struct {
 	context  context.Context
 	loopChan chan string
 	running  atomic.Bool
+	// id identifies this client in library messages
+	id string
 }
 
 func Get() *Redis {
@@ -50,11 +53,13 @@ func (i *Redis) configure() {
 			Password: cfg.Local.Redis.Password,
 			DB:       cfg.Local.Redis.DB,
 		})
-		i.Handle = &Handle{client: rdb, cfg: cfg, cancel: cancel, context: ctx, loopChan: make(chan string, 1)}
+		i.Handle = &Handle{client: rdb, cfg: cfg, cancel: cancel, context: ctx, loopChan: make(chan string, 1), id: xid.New().String()}
 	}
 }
 
 // PushMessage pushes a message to the redis broadcast job channel
+//
+// Clients add broadcast jobs to their library cache, AddPath also adds them to the shared library
 func (r *Handle) PushMessage(msg string) error {
 	if r.client == nil {
 		return RedisNotInitialized
@@ -106,8 +111,8 @@ func (r *Handle) Running() bool {
 // Subscribes to the redis job broadcast channel
 func (r *Handle) subscribe() {
 	if !r.running.Load() {
-		r.pubSub = r.client.Subscribe(r.context, r.cfg.Local.Redis.ChannelPrefix+"-jobs")
-		glg.Infof("redis: starting broadcast subscription to %s", r.cfg.Local.Redis.ChannelPrefix+"-jobs")
+		r.pubSub = r.client.Subscribe(r.context, r.cfg.Local.Redis.ChannelPrefix+"-jobs", r.libraryChannel())
+		glg.Infof("redis: starting broadcast subscription to %s and %s", r.cfg.Local.Redis.ChannelPrefix+"-jobs", r.libraryChannel())
 		go r.receiveLoop()
 	}
 }
@@ -115,6 +120,10 @@ func (r *Handle) subscribe() {
 func (r *Handle) receiveLoop() {
 	r.running.Store(true)
 	cache := cache.Instance()
+	// bootstrap from the shared library, changes received in the meantime are buffered by the subscription
+	if err := r.loadLibrary(); err != nil {
+		glg.Warnf("redis: could not load shared library, scanning media paths instead: %s", err)
+	}
 	for {
 		if r.context.Err() != nil {
 			glg.Infof("redis: stopping job caching")
@@ -124,10 +133,14 @@ func (r *Handle) receiveLoop() {
 		}
 		ch := r.pubSub.Channel()
 		for msg := range ch {
+			if msg.Channel == r.libraryChannel() {
+				r.applyLibrary(msg.Payload)
+				continue
+			}
 			glg.Infof("redis: received job %s", msg.Payload)
 			// doesn't set LastUpdated because this is a broadcast
 			// meaning there is no full refresh of the cache and data is inserted from non fs operations
-			cache.Library.Data = append(cache.Library.Data, msg.Payload)
+			cache.Library.Add(msg.Payload)
 		}
 	}
 }
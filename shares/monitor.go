@@ -0,0 +1,162 @@
+package shares
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/consts"
+	"github.com/Spiritreader/avior-go/globalstate"
+	"github.com/kpango/glg"
+)
+
+var state *globalstate.Data = globalstate.Instance()
+var mutex sync.Mutex
+
+// location is a directory that has to be reachable for jobs to succeed
+type location struct {
+	path string
+	kind string
+}
+
+// Run checks all locations in the configured interval until ctx is done
+func Run(ctx context.Context) {
+	enabled := false
+	for {
+		settings := config.Instance().Local.ShareMonitor
+		if settings.Enabled {
+			Check()
+		} else if enabled {
+			// lift a pause of the monitor once it has been disabled
+			mutex.Lock()
+			resume()
+			mutex.Unlock()
+		}
+		enabled = settings.Enabled
+		interval := settings.Interval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Check checks the reachability of all locations and updates the status.
+//
+// The service is paused if a location is unreachable and resumed once all of them are back,
+// pauses with other reasons are kept. Returns true if all locations are reachable
+func Check() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	cfg := config.Instance()
+	timeout := cfg.Local.ShareMonitor.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	previous := make(map[string]*globalstate.ShareStatus)
+	for _, status := range state.Shares.Locations {
+		previous[status.Kind+status.Path] = status
+	}
+
+	locations := locations(cfg.Local)
+	statuses := make([]*globalstate.ShareStatus, len(locations))
+	var wg sync.WaitGroup
+	for idx := range locations {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			status := &globalstate.ShareStatus{Path: locations[idx].path, Kind: locations[idx].kind, Reachable: true}
+			if err := check(locations[idx].path, timeout); err != nil {
+				status.Reachable = false
+				status.Error = err.Error()
+			}
+			status.Since = time.Now()
+			if prev, ok := previous[status.Kind+status.Path]; ok && prev.Reachable == status.Reachable {
+				status.Since = prev.Since
+			}
+			statuses[idx] = status
+		}(idx)
+	}
+	wg.Wait()
+
+	unreachable := make([]string, 0)
+	for _, status := range statuses {
+		if !status.Reachable {
+			unreachable = append(unreachable, fmt.Sprintf("%s %s (%s)", status.Kind, status.Path, status.Error))
+		}
+	}
+	state.Shares = globalstate.Shares{Checked: time.Now(), Reachable: len(unreachable) == 0, Locations: statuses}
+	if len(unreachable) > 0 {
+		pause(unreachable)
+		return false
+	}
+	resume()
+	return true
+}
+
+// locations returns the media paths, the obsolete path and the encoder output directories
+func locations(local config.Local) []location {
+	locations := make([]location, 0)
+	seen := make(map[string]bool)
+	add := func(path string, kind string) {
+		if len(path) == 0 || seen[kind+path] {
+			return
+		}
+		seen[kind+path] = true
+		locations = append(locations, location{path: path, kind: kind})
+	}
+	for _, path := range local.MediaPaths {
+		add(path, consts.SHARE_KIND_MEDIA)
+	}
+	add(local.ObsoletePath, consts.SHARE_KIND_OBSOLETE)
+	for _, encoderConfig := range local.EncoderConfig {
+		add(encoderConfig.OutDirectory, consts.SHARE_KIND_OUTPUT)
+	}
+	return locations
+}
+
+// check returns an error if path is no directory or doesn't respond within timeout
+func check(path string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		info, err := os.Stat(path)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s is not a directory", path)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no response after %s", timeout)
+	}
+}
+
+func pause(unreachable []string) {
+	if state.Paused {
+		return
+	}
+	_ = glg.Warnf("shares: pausing service, unreachable: %s", strings.Join(unreachable, ", "))
+	state.Paused = true
+	state.PauseReason = consts.PAUSE_REASON_SHARE_UNREACHABLE
+}
+
+// resume resumes the service if it has been paused by the monitor
+func resume() {
+	if !state.Paused || state.PauseReason != consts.PAUSE_REASON_SHARE_UNREACHABLE {
+		return
+	}
+	_ = glg.Info("shares: all locations are reachable again, resuming service")
+	state.Paused = false
+	state.PauseReason = ""
+	globalstate.SendWake()
+}
@@ -0,0 +1,47 @@
+package shares
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/consts"
+)
+
+func TestCheck(t *testing.T) {
+	root := t.TempDir()
+	missing := filepath.Join(root, "tv")
+	cfg := config.Instance()
+	cfg.Local.MediaPaths = []string{root, missing}
+	cfg.Local.ObsoletePath = root
+	cfg.Local.EncoderConfig = map[string]config.EncoderConfig{"hd": {OutDirectory: root}}
+
+	if Check() {
+		t.Fatalf("expected %s to be unreachable", missing)
+	}
+	if !state.Paused || state.PauseReason != consts.PAUSE_REASON_SHARE_UNREACHABLE {
+		t.Errorf("expected the service to be paused, got %t: %s", state.Paused, state.PauseReason)
+	}
+	if len(state.Shares.Locations) != 4 || state.Shares.Locations[1].Reachable {
+		t.Errorf("expected 4 locations with the second one unreachable, got %+v", state.Shares.Locations)
+	}
+
+	if err := os.Mkdir(missing, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if !Check() {
+		t.Fatalf("expected all locations to be reachable")
+	}
+	if state.Paused || !state.Shares.Reachable {
+		t.Errorf("expected the service to be resumed")
+	}
+
+	// pauses with other reasons are kept
+	state.Paused = true
+	state.PauseReason = consts.PAUSE_REASON_ENCODE_ERROR
+	Check()
+	if !state.Paused {
+		t.Errorf("expected the encode error pause to be kept")
+	}
+}
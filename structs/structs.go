@@ -1,6 +1,8 @@
 package structs
 
 import (
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -16,6 +18,14 @@ type Job struct {
 	CustomParameters     []string           `bson:"CustomParameters,omitempty"`
 	AssignedClient       DBRef              `bson:"AssignedClient"`
 	AssignedClientLoaded *Client            `bson:"AssignedClientLoaded,omitempty" json:"-"`
+	Status               string             `bson:"Status,omitempty"`
+	ClaimedBy            string             `bson:"ClaimedBy,omitempty"`
+	LeaseExpiry          time.Time          `bson:"LeaseExpiry,omitempty"`
+	Priority             int32              `bson:"Priority"`
+	EnqueuedAt           time.Time          `bson:"EnqueuedAt,omitempty"`
+	NotBefore            time.Time          `bson:"NotBefore,omitempty"`
+	Deadline             time.Time          `bson:"Deadline,omitempty"`
+	Pooled               bool               `bson:"Pooled,omitempty"`
 }
 
 // Client is a target machine for Avior
@@ -30,6 +40,57 @@ type Client struct {
 	IgnoreOnline      bool               `bson:"IgnoreOnline"`
 }
 
+// JobHistory is the record of a finished job, kept in the job_history collection
+type JobHistory struct {
+	ID         primitive.ObjectID       `bson:"_id,omitempty"`
+	JobID      primitive.ObjectID       `bson:"JobID"`
+	Path       string                   `bson:"Path"`
+	Name       string                   `bson:"Name"`
+	Subtitle   string                   `bson:"Subtitle"`
+	Client     string                   `bson:"Client"`
+	ClaimedBy  string                   `bson:"ClaimedBy"`
+	Status     string                   `bson:"Status"`
+	Reason     string                   `bson:"Reason,omitempty"`
+	Verdicts   []ModuleVerdict          `bson:"Verdicts"`
+	Stats      *EncoderStats            `bson:"Stats,omitempty"`
+	OutputPath string                   `bson:"OutputPath,omitempty"`
+	Started    time.Time                `bson:"Started"`
+	Finished   time.Time                `bson:"Finished"`
+	Timings    map[string]time.Duration `bson:"Timings"`
+}
+
+// SizeSample is the size of a finished encode, kept in the size_samples collection to learn output sizes
+type SizeSample struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	Tag     string             `bson:"Tag"`
+	Profile string             `bson:"Profile"`
+	// Duration of the encode in seconds
+	Duration float64 `bson:"Duration"`
+	// SourceBitrate in kbit/s
+	SourceBitrate float64   `bson:"SourceBitrate"`
+	OutputSize    int64     `bson:"OutputSize"`
+	Recorded      time.Time `bson:"Recorded"`
+}
+
+// ModuleVerdict is the result of a single comparator module run
+type ModuleVerdict struct {
+	Module        string `bson:"Module"`
+	Result        string `bson:"Result"`
+	Message       string `bson:"Message"`
+	DuplicatePath string `bson:"DuplicatePath,omitempty"`
+}
+
+// EncoderStats mirrors the encoder statistics of a finished encode
+type EncoderStats struct {
+	Success    bool          `bson:"Success"`
+	Duration   time.Duration `bson:"Duration"`
+	ExitCode   int           `bson:"ExitCode"`
+	OutputPath string        `bson:"OutputPath"`
+	Call       string        `bson:"Call"`
+	Profile    string        `bson:"Profile,omitempty"`
+	Quality    string        `bson:"Quality,omitempty"`
+}
+
 type Field struct {
 	ID    primitive.ObjectID `bson:"_id,omitempty"`
 	Value string             `bson:"Name"`
@@ -0,0 +1,108 @@
+package tools
+
+import (
+	"encoding/json"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProbeInfo is the container and stream information ffprobe reports for a file
+type ProbeInfo struct {
+	Duration time.Duration
+	Streams  []ProbeStream
+	// Tags are the container tags with upper case keys
+	Tags map[string]string
+}
+
+type ProbeStream struct {
+	Index     int
+	CodecType string
+	CodecName string
+	Channels  int
+	Language  string
+	Title     string
+	// VisualImpaired is set for audio description tracks
+	VisualImpaired  bool
+	HearingImpaired bool
+}
+
+// Count returns the number of streams of a codec type (video, audio, subtitle)
+func (p ProbeInfo) Count(codecType string) int {
+	count := 0
+	for _, stream := range p.Streams {
+		if stream.CodecType == codecType {
+			count++
+		}
+	}
+	return count
+}
+
+// Channels returns the channel count of the first audio stream, -1 if there is none
+func (p ProbeInfo) Channels() int {
+	for _, stream := range p.Streams {
+		if stream.CodecType == "audio" {
+			return stream.Channels
+		}
+	}
+	return -1
+}
+
+type ffprobeOutput struct {
+	Streams []struct {
+		Index       int               `json:"index"`
+		CodecType   string            `json:"codec_type"`
+		CodecName   string            `json:"codec_name"`
+		Channels    int               `json:"channels"`
+		Tags        map[string]string `json:"tags"`
+		Disposition map[string]int    `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		Duration string            `json:"duration"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+// FfProbeInfo reads the container duration and the streams of a file using ffprobe
+func FfProbeInfo(path string) (ProbeInfo, error) {
+	ffprobe := exec.Command("ffprobe", "-v", "quiet", "-show_entries",
+		"format=duration:format_tags:stream=index,codec_type,codec_name,channels:stream_tags=language,title"+
+			":stream_disposition=visual_impaired,hearing_impaired", "-of", "json", path)
+	output, err := ffprobe.Output()
+	if err != nil {
+		return ProbeInfo{}, err
+	}
+	return parseProbe(output)
+}
+
+func parseProbe(output []byte) (ProbeInfo, error) {
+	var probed ffprobeOutput
+	if err := json.Unmarshal(output, &probed); err != nil {
+		return ProbeInfo{}, err
+	}
+	info := ProbeInfo{Streams: make([]ProbeStream, 0, len(probed.Streams)), Tags: make(map[string]string)}
+	for key, value := range probed.Format.Tags {
+		info.Tags[strings.ToUpper(key)] = value
+	}
+	if len(probed.Format.Duration) > 0 {
+		seconds, err := strconv.ParseFloat(probed.Format.Duration, 64)
+		if err != nil {
+			return ProbeInfo{}, err
+		}
+		info.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	for _, stream := range probed.Streams {
+		info.Streams = append(info.Streams, ProbeStream{
+			Index:           stream.Index,
+			CodecType:       stream.CodecType,
+			CodecName:       stream.CodecName,
+			Channels:        stream.Channels,
+			Language:        stream.Tags["language"],
+			Title:           stream.Tags["title"],
+			VisualImpaired:  stream.Disposition["visual_impaired"] == 1,
+			HearingImpaired: stream.Disposition["hearing_impaired"] == 1,
+		})
+	}
+	return info, nil
+}
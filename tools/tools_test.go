@@ -74,3 +74,25 @@ func TestByteCountUpIEC(t *testing.T) {
 		})
 	}
 }
+
+func TestParseProbe(t *testing.T) {
+	output := []byte(`{"streams": [
+		{"index": 0, "codec_name": "h264", "codec_type": "video"},
+		{"index": 1, "codec_name": "ac3", "codec_type": "audio", "channels": 6, "tags": {"language": "deu"}},
+		{"index": 2, "codec_name": "mp2", "codec_type": "audio", "channels": 2, "tags": {"language": "eng"}},
+		{"index": 3, "codec_name": "dvb_subtitle", "codec_type": "subtitle"}
+	], "format": {"duration": "5400.480000"}}`)
+	info, err := parseProbe(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Duration.Seconds() != 5400.48 {
+		t.Errorf("duration = %s, want 1h30m0.48s", info.Duration)
+	}
+	if info.Count("video") != 1 || info.Count("audio") != 2 || info.Count("subtitle") != 1 {
+		t.Errorf("unexpected stream counts: %+v", info.Streams)
+	}
+	if info.Channels() != 6 || info.Streams[2].Language != "eng" {
+		t.Errorf("unexpected audio streams: %+v", info.Streams)
+	}
+}
@@ -0,0 +1,136 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/Spiritreader/avior-go/consts"
+	"github.com/Spiritreader/avior-go/db"
+	"github.com/Spiritreader/avior-go/encoder"
+	"github.com/Spiritreader/avior-go/structs"
+	"github.com/kpango/glg"
+)
+
+// jobTracker moves a job through its lifecycle states and collects its history record
+type jobTracker struct {
+	dataStore  *db.DataStore
+	job        *structs.Job
+	history    *structs.JobHistory
+	phaseStart time.Time
+	// last puts a requeued job at the end of the queue
+	last bool
+}
+
+func newJobTracker(dataStore *db.DataStore, client *structs.Client, job *structs.Job) *jobTracker {
+	now := time.Now()
+	status := job.Status
+	if len(status) == 0 {
+		status = consts.JOB_STATUS_CLAIMED
+	}
+	history := &structs.JobHistory{
+		JobID:     job.ID,
+		Path:      job.Path,
+		Name:      job.Name,
+		Subtitle:  job.Subtitle,
+		ClaimedBy: job.ClaimedBy,
+		Status:    status,
+		Verdicts:  make([]structs.ModuleVerdict, 0),
+		Started:   now,
+		Timings:   make(map[string]time.Duration),
+	}
+	if client != nil {
+		history.Client = client.Name
+	}
+	return &jobTracker{dataStore: dataStore, job: job, history: history, phaseStart: now}
+}
+
+// setStatus records the time spent in the previous state and moves the job to the next one
+func (t *jobTracker) setStatus(status string) {
+	t.record(status)
+	if t.dataStore != nil {
+		_ = t.dataStore.SetJobStatus(t.job, status)
+	}
+}
+
+// record moves the job to the next state in its history only
+func (t *jobTracker) record(status string) {
+	now := time.Now()
+	t.history.Timings[t.history.Status] += now.Sub(t.phaseStart)
+	t.history.Status = status
+	t.phaseStart = now
+	_ = glg.Logf("job %s: %s", t.job.Name, status)
+}
+
+// skip marks the job as skipped with the given reason
+func (t *jobTracker) skip(reason string) {
+	t.history.Reason = reason
+	t.setStatus(consts.JOB_STATUS_SKIPPED)
+}
+
+// fail marks the job as failed with the given reason
+func (t *jobTracker) fail(reason string) {
+	t.history.Reason = reason
+	t.setStatus(consts.JOB_STATUS_FAILED)
+}
+
+// requeue puts the job back into the queue, requeued jobs are not recorded in the history.
+//
+// The status is written by finish together with the release of the claim, so the job never shows up queued while it is claimed
+func (t *jobTracker) requeue(reason string) {
+	t.history.Reason = reason
+	t.record(consts.JOB_STATUS_QUEUED)
+}
+
+// requeueLast puts the job back at the end of the queue, so it isn't picked up again right away
+func (t *jobTracker) requeueLast(reason string) {
+	t.last = true
+	t.requeue(reason)
+}
+
+func (t *jobTracker) addVerdict(module string, result string, message string, duplicatePath string) {
+	t.history.Verdicts = append(t.history.Verdicts, structs.ModuleVerdict{
+		Module:        module,
+		Result:        result,
+		Message:       message,
+		DuplicatePath: duplicatePath,
+	})
+}
+
+func (t *jobTracker) setStats(stats encoder.Stats) {
+	t.history.Stats = &structs.EncoderStats{
+		Success:    stats.Success,
+		Duration:   stats.Duration,
+		ExitCode:   stats.ExitCode,
+		OutputPath: stats.OutputPath,
+		Call:       stats.Call,
+		Profile:    stats.Profile,
+	}
+	if stats.Quality != nil {
+		t.history.Stats.Quality = stats.Quality.String()
+	}
+	t.history.OutputPath = stats.OutputPath
+}
+
+// finish closes the history record and writes it to the job_history collection
+//
+// Jobs that never reached a final state are recorded as failed, requeued jobs are released instead
+func (t *jobTracker) finish() {
+	switch t.history.Status {
+	case consts.JOB_STATUS_QUEUED:
+		_ = glg.Infof("job %s requeued: %s", t.job.Name, t.history.Reason)
+		// the job stays in the queue even if the release fails
+		t.job.Status = consts.JOB_STATUS_QUEUED
+		if t.dataStore != nil && t.last {
+			_ = t.dataStore.RequeueJobLast(t.job)
+		} else if t.dataStore != nil {
+			_ = t.dataStore.RequeueJob(t.job)
+		}
+		return
+	case consts.JOB_STATUS_DONE, consts.JOB_STATUS_SKIPPED, consts.JOB_STATUS_FAILED:
+	default:
+		t.fail("job ended in state " + t.history.Status)
+	}
+	t.history.Finished = time.Now()
+	if t.dataStore != nil {
+		_ = t.dataStore.InsertJobHistory(t.history)
+	}
+}
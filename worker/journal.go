@@ -0,0 +1,190 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/consts"
+	"github.com/Spiritreader/avior-go/db"
+	"github.com/Spiritreader/avior-go/globalstate"
+	"github.com/Spiritreader/avior-go/joblog"
+	"github.com/Spiritreader/avior-go/media"
+	"github.com/Spiritreader/avior-go/structs"
+	"github.com/kpango/glg"
+)
+
+// journal records the completed steps of the job that is currently processed,
+// so an interrupted job can be rolled back or finished on the next start
+type journal struct {
+	Job                   structs.Job
+	MediaFile             media.File
+	Steps                 []string
+	ObsoleteMovedFilePath map[string]string
+	ObsoleteMovedLogPaths map[string]string
+	OutputPath            string
+	// Outcome is the final job status once the source files have been moved
+	Outcome string
+	Updated time.Time
+}
+
+// journalPath returns the journal of this instance, instances that share an executable keep separate journals
+func journalPath() string {
+	name := "journal.json"
+	if instance := config.Instance().Local.Instance; instance > 0 {
+		name = fmt.Sprintf("journal-%d.json", instance)
+	}
+	return filepath.Join(globalstate.ReflectionPath(), name)
+}
+
+func newJournal(job structs.Job) *journal {
+	j := &journal{Job: job, Steps: make([]string, 0)}
+	j.save()
+	return j
+}
+
+// step marks a step as completed and persists the journal
+func (j *journal) step(step string) {
+	j.Steps = append(j.Steps, step)
+	j.save()
+}
+
+func (j *journal) done(step string) bool {
+	for _, s := range j.Steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *journal) save() {
+	j.Updated = time.Now()
+	bytes, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		_ = glg.Errorf("could not serialize job journal: %s", err)
+		return
+	}
+	if err := os.WriteFile(journalPath(), bytes, 0644); err != nil {
+		_ = glg.Errorf("could not write job journal %s: %s", journalPath(), err)
+	}
+}
+
+// close removes the journal once a job has been handled completely
+func (j *journal) close() {
+	if err := os.Remove(journalPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		_ = glg.Errorf("could not remove job journal %s: %s", journalPath(), err)
+	}
+}
+
+func readJournal() (*journal, error) {
+	bytes, err := os.ReadFile(journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	j := new(journal)
+	if err := json.Unmarshal(bytes, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Recover inspects the journal of a job that has been interrupted and either finishes or rolls it back.
+//
+// Jobs whose encode completed are finished by moving the source files to the done directory.
+// All other jobs are rolled back: partial output is renamed, duplicates are moved back from .obsolete
+// and the job is put back into the queue.
+//
+// Nothing is touched if another client has claimed the job after its lease expired,
+// jobs that are no longer claimed by this client are rolled back but not requeued.
+func Recover(dataStore *db.DataStore, client *structs.Client) {
+	j, err := readJournal()
+	if err != nil {
+		_ = glg.Errorf("could not read job journal, interrupted jobs can't be recovered: %s", err)
+		return
+	}
+	if j == nil {
+		return
+	}
+	_ = glg.Warnf("found journal of interrupted job %s (steps: %v), recovering", j.Job.Path, j.Steps)
+	claimed := true
+	if dataStore != nil {
+		current, err := dataStore.GetJob(j.Job.ID)
+		if err != nil {
+			_ = glg.Errorf("could not check claim of interrupted job %s, recovering on next start: %s", j.Job.Path, err)
+			return
+		}
+		if current != nil && len(current.ClaimedBy) > 0 && !db.ClaimedByThisClient(current.ClaimedBy) {
+			_ = glg.Warnf("recovery: job %s has been claimed by %s, leaving its files alone", j.Job.Path, current.ClaimedBy)
+			j.close()
+			return
+		}
+		claimed = current != nil && db.ClaimedByThisClient(current.ClaimedBy)
+	}
+	jobLog := new(joblog.Data)
+	jobLog.Add(fmt.Sprintf("Recovery of interrupted job, completed steps: %v", j.Steps))
+	tracker := newJobTracker(dataStore, client, &j.Job)
+
+	switch {
+	case j.done(consts.JOURNAL_STEP_SOURCE_MOVED):
+		_ = glg.Infof("recovery: source files of %s have already been moved, nothing left to do", j.Job.Path)
+		tracker.history.OutputPath = j.OutputPath
+		tracker.history.Reason = "recovered after interruption"
+		tracker.setStatus(j.Outcome)
+	case j.done(consts.JOURNAL_STEP_ENCODE_FINISHED):
+		_ = glg.Infof("recovery: encode of %s finished, moving source files", j.Job.Path)
+		finishSourceFiles(j.MediaFile, j.OutputPath)
+		tracker.history.OutputPath = j.OutputPath
+		tracker.history.Reason = "recovered after interruption"
+		tracker.setStatus(consts.JOB_STATUS_DONE)
+	default:
+		if j.done(consts.JOURNAL_STEP_ENCODE_STARTED) {
+			renameRemnant(j.OutputPath, "interrupted")
+		}
+		if j.done(consts.JOURNAL_STEP_DUPLICATES_MOVED) {
+			_ = glg.Infof("recovery: rolling back duplicate moves of %s", j.Job.Path)
+			rollbackAllDupMoves(jobLog, j.ObsoleteMovedFilePath, j.ObsoleteMovedLogPaths)
+		}
+		if !claimed {
+			_ = glg.Infof("recovery: %s is no longer claimed by this client, not requeueing", j.Job.Path)
+		} else if dataStore != nil {
+			_ = glg.Infof("recovery: requeueing %s", j.Job.Path)
+			if err := dataStore.RequeueJob(&j.Job); err != nil {
+				_ = glg.Errorf("recovery: could not requeue job %s: %s", j.Job.Path, err)
+			}
+		}
+		_ = jobLog.AppendTo(filepath.Join(globalstate.ReflectionPath(), "log", "skipped.log"), false, true)
+		j.close()
+		return
+	}
+
+	tracker.finish()
+	if dataStore != nil {
+		_, _ = dataStore.DeleteJob(j.Job.ID.Hex())
+	}
+	_ = jobLog.AppendTo(filepath.Join(globalstate.ReflectionPath(), "log", "processed.log"), false, true)
+	j.close()
+}
+
+// renameRemnant renames an incomplete output file so it can't be mistaken for a finished encode
+func renameRemnant(path string, reason string) {
+	if len(path) == 0 {
+		return
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return
+	}
+	ext := filepath.Ext(path)
+	stem := path[:len(path)-len(ext)]
+	newPath := fmt.Sprintf("%s-%s-%s%s", stem, reason, time.Now().Format("2006-01-02 150405"), ext)
+	_ = glg.Warnf("remnant file detected, renaming: %s", path)
+	if err := os.Rename(path, newPath); err != nil {
+		_ = glg.Errorf("could not rename remnant file: %s", err)
+	}
+}
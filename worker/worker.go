@@ -1,12 +1,15 @@
 package worker
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Spiritreader/avior-go/cache"
@@ -16,9 +19,12 @@ import (
 	"github.com/Spiritreader/avior-go/db"
 	"github.com/Spiritreader/avior-go/encoder"
 	"github.com/Spiritreader/avior-go/globalstate"
+	"github.com/Spiritreader/avior-go/janitor"
 	"github.com/Spiritreader/avior-go/joblog"
+	"github.com/Spiritreader/avior-go/library"
 	"github.com/Spiritreader/avior-go/media"
 	"github.com/Spiritreader/avior-go/redis"
+	"github.com/Spiritreader/avior-go/shares"
 	"github.com/Spiritreader/avior-go/structs"
 	"github.com/Spiritreader/avior-go/tools"
 	"github.com/karrick/godirwalk"
@@ -27,18 +33,39 @@ import (
 
 var (
 	state                  *globalstate.Data = globalstate.Instance()
-	previousEncoderLineOut []string
+	previousEncoderLineOut []encoderAttempt
+	// cancelAction is set by CancelCurrentJob from the api and read by the worker
+	cancelAction           atomic.Value
 )
 
+// encoderAttempt holds the encoder output of a failed encode attempt
+type encoderAttempt struct {
+	profile string
+	lineOut []string
+}
+
+// ErrNoJob is returned when there is no job to act upon
+var ErrNoJob = errors.New("no job is being processed")
+var ErrIncompleteScan = errors.New("media paths skipped")
+
 func ProcessJob(dataStore *db.DataStore, client *structs.Client, job *structs.Job, resumeChan chan string) {
 	cfg := config.Instance()
 	state.InFile = job.Path
+	janitor.Protect(job.Path)
 	jobLog := new(joblog.Data)
 	redis := redis.Get()
+	tracker := newJobTracker(dataStore, client, job)
+	journal := newJournal(*job)
+	encoder.ResetCancel()
+	comparator.ResetEstimates()
+	cancelAction.Store(consts.CANCEL_ACTION_REQUEUE)
 	_ = glg.Infof("processing job %s", job.Path)
 
 	//reset global state after job, allow resume without pause
 	defer func() {
+		tracker.finish()
+		journal.close()
+		janitor.Release()
 		lineOut := state.Encoder.LineOut
 		state.Clear()
 		state.Encoder.LineOut = lineOut
@@ -50,19 +77,22 @@ func ProcessJob(dataStore *db.DataStore, client *structs.Client, job *structs.Jo
 	err := mediaFile.Update()
 	if err != nil {
 		_ = glg.Errorf("couldn't parse media file: %s", err)
+		tracker.fail(fmt.Sprintf("couldn't parse media file: %s", err))
 		return
 	}
 	_ = glg.Logf("input file: %s", mediaFile.Path)
 	_ = glg.Logf("trimmed name: %s", mediaFile.OutName())
 	jobLog.AddFileProperties(*mediaFile)
+	journal.MediaFile = *mediaFile
 
 	// run single file modules
 	jobLog.Add("")
-	res := runModules(jobLog, *mediaFile)
+	res := runModules(jobLog, tracker, *mediaFile)
 	switch res {
 	case comparator.DISC:
 		appendJobTemplate(*job, jobLog, false)
 		writeSkippedLog(mediaFile, jobLog, false)
+		tracker.skip("rejected by modules")
 		return
 	}
 
@@ -70,104 +100,162 @@ func ProcessJob(dataStore *db.DataStore, client *structs.Client, job *structs.Jo
 	var redirectDir *string = nil
 	var obsoleteMovedLogPaths map[string]string = nil
 	var obsoleteMovedFilePath map[string]string = nil
+	tracker.setStatus(consts.JOB_STATUS_SCANNING)
 	duplicates, err := checkForDuplicates(mediaFile)
+	if err != nil && cfg.Local.ShareMonitor.Enabled && !shares.Check() {
+		// the share monitor has paused the service and resumes it once the shares are back
+		_ = glg.Warnf("duplicate scan failed while a share is unreachable, requeueing job: %s", err)
+		tracker.requeue(fmt.Sprintf("share unreachable: %s", err))
+		return
+	}
+	if errors.Is(err, ErrIncompleteScan) {
+		// duplicates in the skipped paths would be missed, the job is retried after the rest of the queue
+		_ = glg.Warnf("duplicate scan incomplete, requeueing job: %s", err)
+		jobLog.Add(fmt.Sprintf("Duplicate scan incomplete, requeued: %s", err))
+		appendJobTemplate(*job, jobLog, false)
+		_ = jobLog.AppendTo(filepath.Join(globalstate.ReflectionPath(), "log", "skipped.log"), false, true)
+		tracker.requeueLast(fmt.Sprintf("duplicate scan incomplete: %s", err))
+		return
+	}
 	if err != nil {
 		_ = glg.Errorf("duplicate scan failed, please fix. Pausing service to prevent unwanted behavior: %s", err)
 		state.Paused = true
 		state.PauseReason = consts.PAUSE_REASON_DUPLICATE_SCAN
 		appendJobTemplate(*job, jobLog, false)
 		writeSkippedLog(mediaFile, jobLog, false)
+		tracker.fail(fmt.Sprintf("duplicate scan failed: %s", err))
 		return
 	}
 	if dupeLen := len(duplicates); dupeLen > 0 {
-		_ = glg.Infof("found %d duplicates, selecting first", dupeLen)
+		_ = glg.Infof("found %d duplicates", dupeLen)
 
-		// check if duplicate file actually exists
-		if _, err := os.Stat(duplicates[0].Path); os.IsNotExist(err) {
-			_ = glg.Warnf("duplicate file %s doesn't exist on disk, skipping", duplicates[0].Path)
+		// run dupe file modules for every duplicate that still exists and pick the best copy as comparison target
+		tracker.setStatus(consts.JOB_STATUS_ESTIMATING)
+		candidates := make([]duplicateVerdict, 0, dupeLen)
+		for idx := range duplicates {
+			duplicate := &duplicates[idx]
+			janitor.Protect(duplicate.Path)
+			jobLog.Add("")
+			jobLog.Add(fmt.Sprintf("Duplicate: %s (%s, %.2f)", duplicate.Path, duplicate.Strategy, duplicate.Score))
+			if _, err := os.Stat(duplicate.Path); os.IsNotExist(err) {
+				_ = glg.Warnf("duplicate file %s doesn't exist on disk, ignoring", duplicate.Path)
+				jobLog.Add("Decision: ignored, file doesn't exist on disk")
+				continue
+			}
+			prepareDuplicate(&duplicate.File)
+			res, moduleName := runDupeModules(jobLog, tracker, *mediaFile, duplicate.File)
+			if encoder.Cancelled() {
+				handleCancel(*job, jobLog, mediaFile, tracker, nil, nil)
+				return
+			}
+			candidates = append(candidates, duplicateVerdict{
+				File:              duplicate.File,
+				Result:            res,
+				Module:            moduleName,
+				ReplacementReason: state.Encoder.ReplacementReason,
+			})
+		}
+		if len(candidates) == 0 {
 			appendJobTemplate(*job, jobLog, false)
 			writeSkippedLog(mediaFile, jobLog, false)
+			tracker.skip(fmt.Sprintf("duplicate file %s doesn't exist on disk", duplicates[0].Path))
 			return
 		}
-
-		err = duplicates[0].Update()
-		if err != nil {
-			_ = glg.Warnf("couldn't parse duplicate log file: %s", err)
+		best := bestDuplicate(candidates)
+		target := candidates[best]
+		// copies the modules rate as high as the comparison target are never inferior
+		inferior := make([]media.File, 0, len(candidates)-1)
+		for idx, candidate := range candidates {
+			if idx == best {
+				continue
+			}
+			if duplicateRank[candidate.Result] > duplicateRank[target.Result] {
+				inferior = append(inferior, candidate.File)
+			} else {
+				_ = glg.Infof("keeping duplicate %s, rated %s like the comparison target", candidate.Path, candidate.Result)
+				jobLog.Add(fmt.Sprintf("Decision: %s kept, rated %s like the comparison target", candidate.Path, candidate.Result))
+			}
 		}
-
-		// run dupe file modules and prevent replacement if necessary
+		state.Encoder.ReplacementReason = target.ReplacementReason
+		_ = glg.Infof("selected duplicate %s as comparison target (%s, %s)", target.Path, target.Result, target.Module)
 		jobLog.Add("")
-		res, moduleName := runDupeModules(jobLog, *mediaFile, duplicates[0])
-		switch res {
+		jobLog.Add(fmt.Sprintf("Comparison Target: %s (%s, %s)", target.Path, target.Result, target.Module))
+		obsoleteDir := filepath.Join(cfg.Local.ObsoletePath, consts.OBSOLETE_DIR)
+
+		switch target.Result {
 		case comparator.DISC, comparator.NOCH:
+			for _, file := range inferior {
+				if !cfg.Local.ObsoleteInferiorDuplicates {
+					jobLog.Add(fmt.Sprintf("Decision: %s kept, inferior to comparison target", file.Path))
+					continue
+				}
+				moduleName := "inferior"
+				err, movedFiles, movedLogs := moveDuplicates(jobLog, []media.File{file}, obsoleteDir, &moduleName)
+				if err != nil {
+					_ = glg.Warnf("couldn't move inferior duplicate %s to obsolete directory, err: %s", file.Path, err)
+					jobLog.Add(fmt.Sprintf("Decision: %s kept, move to obsolete directory failed: %s", file.Path, err))
+					continue
+				}
+				trackMoves(consts.OBSOLETE_DIR, movedFiles, movedLogs)
+				_ = glg.Infof("moved inferior duplicate %s to obsolete directory", file.Path)
+				jobLog.Add(fmt.Sprintf("Decision: %s moved to obsolete directory, inferior to comparison target", file.Path))
+			}
+			jobLog.Add(fmt.Sprintf("Decision: %s kept, new file skipped", target.Path))
 			appendJobTemplate(*job, jobLog, true)
 			writeSkippedLog(mediaFile, jobLog, false)
+			tracker.skip(fmt.Sprintf("duplicate %s kept (%s)", target.Path, target.Module))
 			if filepath.Dir(mediaFile.Path) == consts.EXIST_DIR {
 				return
 			}
 			existDir := filepath.Join(filepath.Dir(mediaFile.Path), consts.EXIST_DIR)
-			err, _ = moveMediaFile(*mediaFile, existDir, nil)
+			err, movedFile := moveMediaFile(*mediaFile, existDir, nil)
 			if err != nil {
 				_ = glg.Warnf("couldn't move source media file to exist directory, err: %s", err)
 			}
-			err, _ = moveLogs(*mediaFile, existDir, nil)
+			err, movedLogs := moveLogs(*mediaFile, existDir, nil)
 			if err != nil {
 				_ = glg.Warnf("couldn't move source log files to exist directory, err: %s", err)
 			}
+			trackMoves(consts.EXIST_DIR, movedFile, movedLogs)
+			journal.Outcome = consts.JOB_STATUS_SKIPPED
+			journal.step(consts.JOURNAL_STEP_SOURCE_MOVED)
 			return
 		}
 
-		// if dupe file is eligible for replacement, move it to the .obsolete dir
-		obsoleteDir := filepath.Join(cfg.Local.ObsoletePath, consts.OBSOLETE_DIR)
-		var errL error = nil
-		var errM error
-		errM, obsoleteMovedFilePath = moveMediaFile(duplicates[0], obsoleteDir, &moduleName)
-		if errM != nil {
-			// roll back media file move if log move fails to ensure nothing was moved erroneously
-			// map is structured in "original path": "moved path" pairs, so swap directions to move back
-			src := obsoleteMovedFilePath[duplicates[0].Path]
-			errRollback := tools.MoppyFile(src, duplicates[0].Path, true)
-			if errRollback != nil {
-				msg := fmt.Sprintf("failed to roll back media file move for %s, err: %s", src, errRollback)
-				glg.Errorf(msg)
-				jobLog.Add(fmt.Sprintf("error: %s", msg))
-			}
-		} else {
-			errL, obsoleteMovedLogPaths = moveLogs(duplicates[0], obsoleteDir, &moduleName)
-			if errL != nil {
-				// roll back log move if media file move fails to ensure nothing was moved erroneously
-				// map is structured in "original path": "moved path" pairs, so swap directions to move back
-				for dst, src := range obsoleteMovedLogPaths {
-					errRollback := tools.MoppyFile(src, dst, true)
-					if errRollback != nil {
-						msg := fmt.Sprintf("failed to roll back media file move for %s, err: %s", src, errRollback)
-						glg.Errorf(msg)
-						jobLog.Add(fmt.Sprintf("error: %s", msg))
-					}
-				}
+		// if the best copy is eligible for replacement, move it to the .obsolete dir, inferior copies optionally follow
+		toMove := []media.File{target.File}
+		for _, file := range inferior {
+			if cfg.Local.ObsoleteInferiorDuplicates {
+				toMove = append(toMove, file)
+				jobLog.Add(fmt.Sprintf("Decision: %s replaced, inferior to comparison target", file.Path))
+			} else {
+				jobLog.Add(fmt.Sprintf("Decision: %s kept, inferior to comparison target", file.Path))
 			}
 		}
+		jobLog.Add(fmt.Sprintf("Decision: %s replaced by new file", target.Path))
+		moduleName := target.Module
+		err, obsoleteMovedFilePath, obsoleteMovedLogPaths = moveDuplicates(jobLog, toMove, obsoleteDir, &moduleName)
 
 		// cancel operation if any move failed
-		if errM != nil || errL != nil {
+		if err != nil {
 			msg := "can't continue without moving duplicate files, skipping job"
 			_ = glg.Errorf(msg)
 			jobLog.Add("error:")
-			if errM != nil {
-				jobLog.Add(fmt.Sprintf("error: %s", errM.Error()))
-			}
-			if errL != nil {
-				jobLog.Add(fmt.Sprintf("error: %s", errL.Error()))
-			}
+			jobLog.Add(fmt.Sprintf("error: %s", err.Error()))
 			jobLog.Add(msg)
 			appendJobTemplate(*job, jobLog, false)
 			writeSkippedLog(mediaFile, jobLog, false)
+			tracker.fail(msg)
 			return
 		}
 		// when everything is successful, set the redirect dir to the dupe dir so the media file encode
 		// destination is the same as the dupe file
-		duplicateDir := filepath.Dir(duplicates[0].Path)
+		duplicateDir := filepath.Dir(target.Path)
 		redirectDir = &duplicateDir
+		trackMoves(consts.OBSOLETE_DIR, obsoleteMovedFilePath, obsoleteMovedLogPaths)
+		journal.ObsoleteMovedFilePath = obsoleteMovedFilePath
+		journal.ObsoleteMovedLogPaths = obsoleteMovedLogPaths
+		journal.step(consts.JOURNAL_STEP_DUPLICATES_MOVED)
 	}
 
 	jobLog.Add("")
@@ -181,11 +269,45 @@ func ProcessJob(dataStore *db.DataStore, client *structs.Client, job *structs.Jo
 		cache.Instance().Library.Valid = false
 	}
 
-	previousEncoderLineOut = make([]string, 0)
-	stats, err := encoder.Encode(*mediaFile, 0, 0, false, redirectDir)
-	jobLog.Add(fmt.Sprintf("OutputPath: %s", state.Encoder.OutPath))
+	if encoder.Cancelled() {
+		handleCancel(*job, jobLog, mediaFile, tracker, obsoleteMovedFilePath, obsoleteMovedLogPaths)
+		return
+	}
+
+	previousEncoderLineOut = make([]encoderAttempt, 0)
+	tracker.setStatus(consts.JOB_STATUS_ENCODING)
+	journal.OutputPath, _ = encoder.OutputPath(*mediaFile, redirectDir)
+	journal.step(consts.JOURNAL_STEP_ENCODE_STARTED)
+
+	// every profile is attempted once, falling back to the next one if it fails.
+	// A single profile gets one retry that overwrites (in case the old one failed)
+	attempts := []int{0, 0}
+	if profiles, err := encoder.Profiles(*mediaFile); err == nil && len(profiles) > 1 {
+		attempts = make([]int, len(profiles))
+		for idx := range profiles {
+			attempts[idx] = idx
+		}
+	}
+	var stats encoder.Stats
+	for attempt, profile := range attempts {
+		if attempt > 0 {
+			previousEncoderLineOut = append(previousEncoderLineOut, encoderAttempt{stats.Profile, state.Encoder.LineOut})
+		}
+		// allow overwrite for retries to avoid them failing immediately
+		var err error
+		stats, err = encoder.EncodeWithProfile(*mediaFile, profile, 0, 0, attempt > 0, redirectDir)
+		tracker.setStats(stats)
+		if attempt == 0 {
+			jobLog.Add(fmt.Sprintf("OutputPath: %s", state.Encoder.OutPath))
+		}
+		if err == nil {
+			break
+		}
+		if errors.Is(err, encoder.ErrCancelled) {
+			handleCancel(*job, jobLog, mediaFile, tracker, obsoleteMovedFilePath, obsoleteMovedLogPaths)
+			return
+		}
 
-	if err != nil {
 		isBricked := false
 		if errors.Is(err, encoder.ErrNoTag) {
 			jobLog.Add(fmt.Sprintf("no encoder config found for tag %s, file %s", mediaFile.Resolution.Tag, mediaFile.Path))
@@ -203,41 +325,65 @@ func ProcessJob(dataStore *db.DataStore, client *structs.Client, job *structs.Jo
 			_ = glg.Infof("skipping file")
 			appendJobTemplate(*job, jobLog, false)
 			writeSkippedLog(mediaFile, jobLog, false)
+			tracker.fail(fmt.Sprintf("encode error: %s", err))
 			if redirectDir != nil {
 				rollbackAllDupMoves(jobLog, obsoleteMovedFilePath, obsoleteMovedLogPaths)
 			}
-			if (cfg.Local.PauseOnEncodeError) {
+			if cfg.Local.PauseOnEncodeError {
 				state.Paused = true
 				state.PauseReason = consts.PAUSE_REASON_ENCODE_ERROR
 			}
 			return
 		}
 
-		// if the error is non bricking, attempt a re-encode
-		_ = glg.Warnf("encode failed, retrying")
-		// allow overwrite for retry to avoid it failing immediately
-		var errRetry error
-		previousEncoderLineOut = state.Encoder.LineOut
-		stats, errRetry = encoder.Encode(*mediaFile, 0, 0, true, redirectDir)
-		if errRetry != nil {
-			_ = glg.Errorf("retrying encode failed. ffmpeg output has been appended to info log, file path: %s, err: %s", job.Path, errRetry)
-			_ = glg.Infof("skipping file")
-			jobLog.Add("Encode retry error: " + errRetry.Error())
-			appendJobTemplate(*job, jobLog, false)
-			writeSkippedLog(mediaFile, jobLog, true)
-			if redirectDir != nil {
-				rollbackAllDupMoves(jobLog, obsoleteMovedFilePath, obsoleteMovedLogPaths)
-			}
-			if (cfg.Local.PauseOnEncodeError) {
-				state.Paused = true
-				state.PauseReason = consts.PAUSE_REASON_ENCODE_ERROR
-			}
-			return
+		jobLog.Add(fmt.Sprintf("Encode with profile %s failed: %s", stats.Profile, err))
+		if stats.Quality != nil {
+			jobLog.Add(fmt.Sprintf("Quality: %s", stats.Quality))
+		}
+		// retrying the same profile won't improve the quality
+		lowQualityRetry := errors.Is(err, encoder.ErrLowQuality) && attempt < len(attempts)-1 && attempts[attempt+1] == profile
+		if attempt < len(attempts)-1 && !lowQualityRetry {
+			// if the error is non bricking, attempt a re-encode with the next profile
+			_ = glg.Warnf("encode with profile %s failed, retrying", stats.Profile)
+			continue
+		}
+		_ = glg.Errorf("retrying encode failed. ffmpeg output has been appended to info log, file path: %s, err: %s", job.Path, err)
+		_ = glg.Infof("skipping file")
+		jobLog.Add("Encode retry error: " + err.Error())
+		appendJobTemplate(*job, jobLog, false)
+		writeSkippedLog(mediaFile, jobLog, true)
+		tracker.fail(fmt.Sprintf("encode retry error: %s", err))
+		if redirectDir != nil {
+			rollbackAllDupMoves(jobLog, obsoleteMovedFilePath, obsoleteMovedLogPaths)
+		}
+		if cfg.Local.PauseOnEncodeError {
+			state.Paused = true
+			state.PauseReason = consts.PAUSE_REASON_ENCODE_ERROR
+		}
+		return
+	}
+
+	// a cancel during the last steps of the encode must not finish the source files
+	if encoder.Cancelled() {
+		_ = glg.Warnf("job has been cancelled after encoding, removing output %s", stats.OutputPath)
+		if err := os.Remove(stats.OutputPath); err != nil && !os.IsNotExist(err) {
+			_ = glg.Errorf("could not remove output: %s", err)
 		}
+		handleCancel(*job, jobLog, mediaFile, tracker, obsoleteMovedFilePath, obsoleteMovedLogPaths)
+		return
 	}
 
+	journal.OutputPath = stats.OutputPath
+	journal.step(consts.JOURNAL_STEP_ENCODE_FINISHED)
 	_ = glg.Infof("encode to %s done in %s", stats.OutputPath, stats.Duration)
 	jobLog.Add(fmt.Sprintf("Duration: %s", stats.Duration))
+	jobLog.Add(fmt.Sprintf("Profile: %s", stats.Profile))
+	if stats.Trim != nil {
+		jobLog.Add(fmt.Sprintf("Trim: %s", stats.Trim))
+	}
+	if stats.Quality != nil {
+		jobLog.Add(fmt.Sprintf("Quality: %s", stats.Quality))
+	}
 	jobLog.Add(fmt.Sprintf("Parameters: %s", stats.Call))
 	_ = jobLog.AppendTo(filepath.Join(globalstate.ReflectionPath(), "log", "processed.log"), false, true)
 
@@ -245,29 +391,130 @@ func ProcessJob(dataStore *db.DataStore, client *structs.Client, job *structs.Jo
 	mediaFile.SanitizeLog()
 	_ = jobLog.AppendTo(mediaFile.LogPaths[0], true, false)
 
+	recordSize(*mediaFile, stats)
+
 	// move source files, cleanup
+	tracker.setStatus(consts.JOB_STATUS_MOVING)
+	finishSourceFiles(*mediaFile, stats.OutputPath)
+	journal.Outcome = consts.JOB_STATUS_DONE
+	journal.step(consts.JOURNAL_STEP_SOURCE_MOVED)
+
+	// index the encode without waiting for a filesystem notification or rescan
+	if index := library.Get(); index != nil {
+		if err := index.Add(stats.OutputPath); err != nil {
+			_ = glg.Warnf("library: couldn't index %s, err: %s", stats.OutputPath, err)
+		}
+	}
+
+	// add the encode to the shared library if redis is enabled
+	if (redis.Handle.Running()) {
+		_ = glg.Infof("redis: broadcasting job %s", stats.OutputPath)
+		err := redis.Handle.AddPath(stats.OutputPath)
+		if err != nil {
+			_ = glg.Warnf("redis: couldn't broadcast job, err: %s", err)
+		}
+	}
+	tracker.setStatus(consts.JOB_STATUS_DONE)
+}
+
+// recordSize adds the sizes of a finished encode to the size model
+func recordSize(mediaFile media.File, stats encoder.Stats) {
+	model := comparator.GetSizeModel()
+	if model == nil {
+		return
+	}
+	recorded := float64(mediaFile.RecordedLength * 60)
+	if recorded <= 0 {
+		return
+	}
+	// the size of bitrate and size targeted encodes is set by the target, it would skew the samples of the profile
+	if profiles, err := encoder.Profiles(mediaFile); err == nil {
+		for _, profile := range profiles {
+			if profile.Name == stats.Profile && profile.Mode != "" && profile.Mode != consts.ENCODE_MODE_ARGUMENTS {
+				return
+			}
+		}
+	}
+	source, err := os.Stat(mediaFile.Path)
+	if err != nil {
+		return
+	}
+	output, err := os.Stat(stats.OutputPath)
+	if err != nil {
+		return
+	}
+	// only the trimmed part of the source has been encoded
+	duration, sourceSize := recorded, source.Size()
+	if stats.Trim != nil {
+		duration = stats.Trim.End - stats.Trim.Start
+		sourceSize = int64(float64(sourceSize) * duration / recorded)
+	}
+	if err := model.Record(mediaFile.Resolution.Tag, stats.Profile, duration, sourceSize, output.Size()); err != nil {
+		_ = glg.Warnf("could not record size sample: %s", err)
+	}
+}
+
+// CancelCurrentJob stops the job that is currently being processed, including a running encode.
+//
+// action determines what happens to the job afterwards, it is either requeued or skipped
+func CancelCurrentJob(action string) error {
+	if action != consts.CANCEL_ACTION_REQUEUE && action != consts.CANCEL_ACTION_SKIP {
+		return fmt.Errorf("invalid cancel action %s", action)
+	}
+	if len(state.InFile) == 0 {
+		return ErrNoJob
+	}
+	_ = glg.Infof("cancelling job %s (%s)", state.InFile, action)
+	cancelAction.Store(action)
+	encoder.Cancel()
+	return nil
+}
+
+// handleCancel rolls back all duplicate moves of a cancelled job and requeues or skips it
+func handleCancel(job structs.Job, jobLog *joblog.Data, mediaFile *media.File, tracker *jobTracker,
+	fileRollbackPath map[string]string, logsRollbackPaths map[string]string) {
+	_ = glg.Warnf("job %s has been cancelled", job.Path)
+	jobLog.Add("Job cancelled by user")
+	rollbackAllDupMoves(jobLog, fileRollbackPath, logsRollbackPaths)
+	if cancelAction.Load() == consts.CANCEL_ACTION_SKIP {
+		appendJobTemplate(job, jobLog, false)
+		writeSkippedLog(mediaFile, jobLog, false)
+		tracker.skip("cancelled by user")
+		return
+	}
+	tracker.requeueLast("cancelled by user")
+}
+
+// finishSourceFiles moves the source files of a successful encode to the done directory
+// and copies its logs next to the encoded output
+func finishSourceFiles(mediaFile media.File, outputPath string) {
 	doneDir := filepath.Join(filepath.Dir(mediaFile.Path), consts.DONE_DIR)
-	err, _ = moveMediaFile(*mediaFile, doneDir, nil)
+	err, movedFile := moveMediaFile(mediaFile, doneDir, nil)
 	if err != nil {
 		_ = glg.Errorf("couldn't move source media file to done directory, err: %s", err)
 	}
-	err = copyLogsToEncOut(*mediaFile, filepath.Dir(stats.OutputPath))
+	err = copyLogsToEncOut(mediaFile, filepath.Dir(outputPath))
 	if err != nil {
 		_ = glg.Errorf("couldn't copy source log files to encoded file directory, err: %s", err)
 	}
-	err, _ = moveLogs(*mediaFile, doneDir, nil)
+	err, movedLogs := moveLogs(mediaFile, doneDir, nil)
 	if err != nil {
 		_ = glg.Errorf("couldn't move source media file to done directory, err: %s", err)
 	}
+	trackMoves(consts.DONE_DIR, movedFile, movedLogs)
+}
 
-	// broadcast job if redis is enabled
-	if (redis.Handle.Running()) {
-		_ = glg.Infof("redis: broadcasting job %s", stats.OutputPath)
-		err := redis.Handle.PushMessage(stats.OutputPath)
-		if err != nil {
-			_ = glg.Warnf("redis: couldn't broadcast job, err: %s", err)
+// trackMoves registers the files that have been moved to a directory of kind for the retention policies
+func trackMoves(kind string, moved ...map[string]string) {
+	paths := make([]string, 0)
+	for _, m := range moved {
+		for _, dst := range m {
+			if _, err := os.Stat(dst); err == nil {
+				paths = append(paths, dst)
+			}
 		}
 	}
+	janitor.Track(kind, paths...)
 }
 
 func Resume(resumeChan chan string) {
@@ -293,6 +540,10 @@ func rollbackAllDupMoves(jobLog *joblog.Data, fileRollbackPath map[string]string
 			jobLog.Add(fmt.Sprintf("error: %s", msg))
 			return
 		}
+		if index := library.Get(); index != nil {
+			_ = index.Add(destination)
+		}
+		shareMoves(map[string]string{source: destination})
 	}
 	// destination and source are switched because the logsRollbackPaths are outputted from moveLogs, which
 	// originally moves them from the source to the destination, since we want to reverse the process we need to
@@ -333,9 +584,13 @@ func appendJobTemplate(job structs.Job, jobLog *joblog.Data, moved bool) {
 func appendFfmpegOutput(jobLog *joblog.Data, encoderState globalstate.Encoder) {
 	jobLog.Add("FFmpeg Output:")
 	hasData := false
-	if len(previousEncoderLineOut) > 0 {
-		jobLog.Add("Initial Attempt:")
-		jobLog.Add(fmt.Sprintf("%v", previousEncoderLineOut))
+	for idx, attempt := range previousEncoderLineOut {
+		if idx == 0 {
+			jobLog.Add(fmt.Sprintf("Initial Attempt (profile %s):", attempt.profile))
+		} else {
+			jobLog.Add(fmt.Sprintf("\nAttempt %d (profile %s):", idx+1, attempt.profile))
+		}
+		jobLog.Add(fmt.Sprintf("%v", attempt.lineOut))
 		hasData = true
 	}
 	if len(encoderState.LineOut) > 0 {
@@ -348,10 +603,11 @@ func appendFfmpegOutput(jobLog *joblog.Data, encoderState globalstate.Encoder) {
 	}
 }
 
-func runModules(jobLog *joblog.Data, fileNew media.File) string {
+func runModules(jobLog *joblog.Data, tracker *jobTracker, fileNew media.File) string {
 	jobLog.Add("Module Results:")
 	if fileNew.AllowReplacement {
 		jobLog.Add("AllowReplacement: manual user override")
+		tracker.addVerdict(consts.MODULE_FLAG_SKIP, comparator.REPL, "manual user override", "")
 		_ = glg.Info("modules: manual user override, allow replacement")
 		return comparator.REPL
 	}
@@ -360,6 +616,7 @@ func runModules(jobLog *joblog.Data, fileNew media.File) string {
 		name, result, message := modules[idx].Run(fileNew)
 		_ = glg.Infof("%s: %s - %s", name, result, message)
 		jobLog.Add(fmt.Sprintf("%s: %s - %s", name, result, message))
+		tracker.addVerdict(name, result, message, "")
 
 		switch result {
 		case comparator.NOCH:
@@ -373,11 +630,12 @@ func runModules(jobLog *joblog.Data, fileNew media.File) string {
 	return comparator.NOCH
 }
 
-func runDupeModules(jobLog *joblog.Data, fileNew media.File, fileDup media.File) (string, string) {
+func runDupeModules(jobLog *joblog.Data, tracker *jobTracker, fileNew media.File, fileDup media.File) (string, string) {
 	jobLog.Add("Dupe Module Results:")
 	jobLog.Add(fmt.Sprintf("DupPath: %s", fileDup.Path))
 	if fileNew.AllowReplacement {
 		jobLog.Add("AllowReplacement: manual user override")
+		tracker.addVerdict(consts.MODULE_FLAG_SKIP, comparator.REPL, "manual user override", fileDup.Path)
 		return comparator.REPL, "AllowReplacement"
 	}
 	modules := comparator.InitDupeModules()
@@ -385,6 +643,7 @@ func runDupeModules(jobLog *joblog.Data, fileNew media.File, fileDup media.File)
 		name, result, message := modules[idx].Run(fileNew, fileDup)
 		_ = glg.Infof("%s: %s - %s", name, result, message)
 		jobLog.Add(fmt.Sprintf("%s: %s - %s", name, result, message))
+		tracker.addVerdict(name, result, message, fileDup.Path)
 
 		switch result {
 		case comparator.NOCH:
@@ -399,6 +658,106 @@ func runDupeModules(jobLog *joblog.Data, fileNew media.File, fileDup media.File)
 	return comparator.NOCH, "none"
 }
 
+// duplicateVerdict is the result of the dupe modules for one duplicate
+type duplicateVerdict struct {
+	media.File
+	Result            string
+	Module            string
+	ReplacementReason string
+}
+
+// prepareDuplicate reads the logs of a duplicate, encodes carry their origin in tags when the logs are gone
+func prepareDuplicate(duplicate *media.File) {
+	err := duplicate.Update()
+	if err != nil {
+		_ = glg.Warnf("couldn't parse duplicate log file: %s", err)
+	}
+	if err != nil || duplicate.Legacy() {
+		if err := duplicate.ReadTags(); err != nil {
+			_ = glg.Warnf("couldn't read duplicate tags: %s", err)
+		} else if source, ok := duplicate.Tags[consts.TAG_SOURCE]; ok {
+			_ = glg.Infof("duplicate has been encoded by avior from %s", source)
+		}
+	}
+}
+
+// duplicateRank orders the verdicts of the dupe modules from the copy that is most wanted
+var duplicateRank = map[string]int{comparator.DISC: 0, comparator.NOCH: 1, comparator.REPL: 2}
+
+// bestDuplicate returns the index of the copy the dupe modules most want to keep.
+//
+// Ties go to the higher resolution and then to the more reliable match
+func bestDuplicate(candidates []duplicateVerdict) int {
+	best := 0
+	for idx := 1; idx < len(candidates); idx++ {
+		candidate, current := candidates[idx], candidates[best]
+		if duplicateRank[candidate.Result] != duplicateRank[current.Result] {
+			if duplicateRank[candidate.Result] < duplicateRank[current.Result] {
+				best = idx
+			}
+			continue
+		}
+		candidatePixels, _ := candidate.Resolution.GetPixels()
+		currentPixels, _ := current.Resolution.GetPixels()
+		if candidatePixels > currentPixels {
+			best = idx
+		}
+	}
+	return best
+}
+
+// Moves duplicates and their logs to the dstDir location.
+//
+// If any move fails, all moves are rolled back.
+//
+// # Returns the moved media files and logs as maps of old path to new path
+func moveDuplicates(jobLog *joblog.Data, files []media.File, dstDir string, moduleName *string) (error, map[string]string, map[string]string) {
+	movedFiles := make(map[string]string)
+	movedLogs := make(map[string]string)
+	for _, file := range files {
+		errM, movedFile := moveMediaFile(file, dstDir, moduleName)
+		if errM != nil {
+			// roll back the failed move separately, it may not have left anything behind
+			rollbackAllDupMoves(jobLog, movedFile, nil)
+			rollbackAllDupMoves(jobLog, movedFiles, movedLogs)
+			return errM, nil, nil
+		}
+		for src, dst := range movedFile {
+			movedFiles[src] = dst
+		}
+		errL, movedLog := moveLogs(file, dstDir, moduleName)
+		for src, dst := range movedLog {
+			movedLogs[src] = dst
+		}
+		if errL != nil {
+			rollbackAllDupMoves(jobLog, movedFiles, movedLogs)
+			return errL, nil, nil
+		}
+	}
+	if index := library.Get(); index != nil {
+		for src := range movedFiles {
+			if err := index.Remove(src); err != nil {
+				_ = glg.Warnf("library: couldn't remove %s from index, err: %s", src, err)
+			}
+		}
+	}
+	shareMoves(movedFiles)
+	return nil, movedFiles, movedLogs
+}
+
+// shareMoves publishes media file moves given as "from": "to" pairs to the shared library if redis is enabled
+func shareMoves(moved map[string]string) {
+	handle := redis.Get().Handle
+	if len(moved) == 0 || !handle.Running() {
+		return
+	}
+	for from, to := range moved {
+		if err := handle.MovePath(from, to); err != nil {
+			_ = glg.Warnf("redis: couldn't share move of %s, err: %s", from, err)
+		}
+	}
+}
+
 // Writes the skipped logs to the skipped log file and the media file info log.
 //
 // If the withFfmpegOut flag is set, the ffmpeg output will be appended to the info log, but not to the skipped log.
@@ -449,7 +808,7 @@ func moveMediaFile(file media.File, dstDir string, moduleName *string) (error, m
 //
 // # Returns the new paths of the file it was moved to as a map of old path to new path
 //
-// In case of an error, the path of the failed move will still be returned for rollback purposes
+// In case of an error, the paths moved so far and the path of the failed move will still be returned for rollback purposes
 func moveLogs(file media.File, dstDir string, moduleName *string) (error, map[string]string) {
 	_, err := os.Stat(dstDir)
 	if os.IsNotExist(err) {
@@ -467,10 +826,12 @@ func moveLogs(file media.File, dstDir string, moduleName *string) (error, map[st
 		logOut = filepath.Join(dstDir, logOut)
 		toMovePaths[log] = logOut
 	}
+	movedPaths := make(map[string]string)
 	for src, dst := range toMovePaths {
+		movedPaths[src] = dst
 		err := tools.MoppyFile(src, dst, true)
 		if err != nil {
-			return err, map[string]string{src: dst}
+			return err, movedPaths
 		}
 	}
 	return nil, toMovePaths
@@ -500,7 +861,7 @@ func copyLogsToEncOut(file media.File, dstDir string) error {
 // checkForDuplicates retrieves all duplicates for the given file,
 //
 // given a slice of media paths that should be searched
-func checkForDuplicates(file *media.File) ([]media.File, error) {
+func checkForDuplicates(file *media.File) ([]media.Match, error) {
 	cfg := config.Instance()
 	state.FileWalker.Active = true
 	defer func() {
@@ -509,54 +870,95 @@ func checkForDuplicates(file *media.File) ([]media.File, error) {
 
 	state.FileWalker.Position = 0
 	state.FileWalker.LibSize = cfg.Local.EstimatedLibSize
-	matches := make([]media.File, 0)
+	matches := make([]media.Match, 0)
+	matcher := media.NewMatcher(*file, cfg.Local.Ext, cfg.Local.DuplicateMatching)
+
+	// the shared library of redis takes precedence, the library index replaces the scan once it has been built
+	// for the current media paths
+	sharedLibrary := redis.Get().Handle.Running()
+	if index := library.Get(); !sharedLibrary && index != nil && index.Ready(cfg.Local.MediaPaths) {
+		_ = glg.Infof("scanning via library index")
+		state.FileWalker.Directory = "library index"
+		matches = traverseIndex(matcher, index)
+		state.FileWalker.Position = 0
+		media.SortMatches(matches)
+		return matches, nil
+	}
 
 	libCache := &cache.Instance().Library
 
-	// if redis is enabled the cache lifetime is determined by ttl
-	if redis.Get().Handle.Running() && (time.Now().Add(-cfg.Local.Redis.CacheTtl)).After(libCache.LastUpdate) {
+	// if redis is enabled the cache lifetime is determined by ttl, the first client to scan shares the result
+	if sharedLibrary && (time.Now().Add(-cfg.Local.Redis.CacheTtl)).After(libCache.LastUpdate) {
 		_ = glg.Infof("invalidating shared cache after %s due to ttl", cfg.Local.Redis.CacheTtl)
 		libCache.Valid = false
-	} else if !redis.Get().Handle.Running() && (time.Now().Add(-time.Minute * 5)).After(libCache.LastUpdate) {
+	} else if !sharedLibrary && (time.Now().Add(-time.Minute * 5)).After(libCache.LastUpdate) {
 		_ = glg.Infof("auto invalidating local lib cache after 5 minutes")
 		libCache.Valid = false
 	}
 
-	fillCache := false
 	if !libCache.Valid {
-		fillCache = true
-		previousLength := len(libCache.Data)
-		libCache.Data = make([]string, 0, previousLength)
-		for idx, path := range cfg.Local.MediaPaths {
-			state.FileWalker.Directory = path
-			_ = glg.Infof("scanning directory (%d/%d): %s", idx+1, len(cfg.Local.MediaPaths), path)
-			dir_matches, err := traverseDir(file, path, fillCache)
-			if err != nil {
-				return []media.File{}, err
+		state.FileWalker.Directory = "media paths"
+		dirMatches, paths, skipped, err := walkMediaPaths(matcher, cfg.Local.MediaPaths, cfg.Local.LibraryWalk)
+		if err != nil {
+			return []media.Match{}, err
+		}
+		// a partial library would hide duplicates in the skipped paths from this and later jobs
+		if len(skipped) > 0 {
+			return []media.Match{}, fmt.Errorf("%w: %s", ErrIncompleteScan, strings.Join(skipped, ", "))
+		}
+		matches = append(matches, dirMatches...)
+		libCache.Replace(paths, time.Now())
+		cfg.Local.EstimatedLibSize = len(paths)
+		if sharedLibrary {
+			if err := redis.Get().Handle.ReplaceLibrary(paths); err != nil {
+				_ = glg.Warnf("redis: couldn't share library, err: %s", err)
 			}
-			matches = append(matches, dir_matches...)
 		}
-		libCache.Valid = true
-		libCache.LastUpdate = time.Now()
-		cfg.Local.EstimatedLibSize = state.FileWalker.Position
 	} else {
 		_ = glg.Infof("scanning via memcache")
 		state.FileWalker.Directory = "mem cache"
-		matches = append(matches, traverseMemCache(file, libCache)...)
+		matches = append(matches, traverseMemCache(matcher, libCache)...)
 	}
 	state.FileWalker.Position = 0
+	media.SortMatches(matches)
 	// save the config file to update the library size
 	_ = config.Save()
 	return matches, nil
 }
 
-func traverseMemCache(file *media.File, libCache *cache.Library) []media.File {
-	matches := make([]media.File, 0)
-	for _, path := range libCache.Data {
-		if filepath.Base(path) == file.OutName()+config.Instance().Local.Ext {
-			_ = glg.Infof("found duplicate: %s", path)
-			file := &media.File{Path: path}
-			matches = append(matches, *file)
+// traverseIndex matches the indexed files with the same normalized name or event id, fuzzy matching needs all of them
+func traverseIndex(matcher *media.Matcher, index *library.Index) []media.Match {
+	matches := make([]media.Match, 0)
+	var candidates []string
+	if matcher.Exhaustive() {
+		candidates = index.Paths()
+	} else {
+		candidates = index.Lookup(matcher.Name())
+		if eventID := matcher.EventID(); eventID != "" {
+			candidates = append(candidates, index.LookupEvent(eventID)...)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, path := range candidates {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		if match, ok := matcher.Match(path); ok {
+			_ = glg.Infof("found duplicate: %s (%s, %.2f)", path, match.Strategy, match.Score)
+			matches = append(matches, match)
+		}
+		state.FileWalker.Position++
+	}
+	return matches
+}
+
+func traverseMemCache(matcher *media.Matcher, libCache *cache.Library) []media.Match {
+	matches := make([]media.Match, 0)
+	for _, path := range libCache.Paths() {
+		if match, ok := matcher.Match(path); ok {
+			_ = glg.Infof("found duplicate: %s (%s, %.2f)", path, match.Strategy, match.Score)
+			matches = append(matches, match)
 		}
 		if state.FileWalker.Position%1000 == 0 {
 			_ = glg.Logf("current dir: %s, position: %d/%d",
@@ -567,33 +969,120 @@ func traverseMemCache(file *media.File, libCache *cache.Library) []media.File {
 	return matches
 }
 
-func traverseDir(file *media.File, path string, fillCache bool) ([]media.File, error) {
-	matches := make([]media.File, 0)
+// walkResult is the outcome of walking a single media path
+type walkResult struct {
+	matches []media.Match
+	paths   []string
+	err     error
+}
+
+// walkMediaPaths walks the media paths for duplicates with bounded concurrency.
+//
+// Paths that time out are skipped and returned as skipped.
+// Other errors fail the whole walk
+func walkMediaPaths(matcher *media.Matcher, mediaPaths []string, settings config.LibraryWalk) ([]media.Match, []string, []string, error) {
+	concurrency := settings.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	progress := make([]*globalstate.PathProgress, len(mediaPaths))
+	for idx, path := range mediaPaths {
+		progress[idx] = &globalstate.PathProgress{Path: path}
+	}
+	state.FileWalker.Paths = progress
+	results := make([]walkResult, len(mediaPaths))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for idx := range mediaPaths {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			_ = glg.Infof("scanning directory (%d/%d): %s", idx+1, len(mediaPaths), mediaPaths[idx])
+			progress[idx].Active = true
+			results[idx] = walkWithTimeout(matcher, mediaPaths[idx], progress[idx], settings.Timeout)
+			progress[idx].Active = false
+			progress[idx].Done = true
+		}(idx)
+	}
+	wg.Wait()
+
+	matches := make([]media.Match, 0)
+	paths := make([]string, 0)
+	skipped := make([]string, 0)
+	for idx, result := range results {
+		if progress[idx].TimedOut {
+			_ = glg.Warnf("scanning %s timed out after %s, skipping it", mediaPaths[idx], settings.Timeout)
+			skipped = append(skipped, mediaPaths[idx])
+			continue
+		}
+		if result.err != nil {
+			return nil, nil, nil, result.err
+		}
+		matches = append(matches, result.matches...)
+		paths = append(paths, result.paths...)
+	}
+	return matches, paths, skipped, nil
+}
+
+// walkWithTimeout walks path and gives up after timeout, 0 waits indefinitely.
+//
+// A walk that hangs on an unreachable share is abandoned, it stops at its next file
+func walkWithTimeout(matcher *media.Matcher, path string, progress *globalstate.PathProgress, timeout time.Duration) walkResult {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	done := make(chan walkResult, 1)
+	go func() {
+		matches, paths, err := traverseDir(ctx, matcher, path, progress)
+		done <- walkResult{matches: matches, paths: paths, err: err}
+	}()
+	var result walkResult
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		progress.TimedOut = true
+	}
+	return result
+}
+
+// traverseDir walks path for duplicates until ctx is done, it also returns all media files below path
+func traverseDir(ctx context.Context, matcher *media.Matcher, path string, progress *globalstate.PathProgress) ([]media.Match, []string, error) {
+	matches := make([]media.Match, 0)
+	paths := make([]string, 0)
 	err := godirwalk.Walk(path, &godirwalk.Options{
 		Unsorted: true,
 		Callback: func(path string, de *godirwalk.Dirent) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			if de.IsDir() && strings.HasPrefix(de.Name(), ".") {
 				return errors.New("directory ignored")
 			}
-			if !de.IsDir() && de.Name() == (file.OutName()+config.Instance().Local.Ext) {
-				file := &media.File{Path: path}
-				_ = glg.Infof("found duplicate: %s", path)
-				matches = append(matches, *file)
+			if !de.IsDir() {
+				if match, ok := matcher.Match(path); ok {
+					_ = glg.Infof("found duplicate: %s (%s, %.2f)", path, match.Strategy, match.Score)
+					matches = append(matches, match)
+				}
 			}
 			if !de.IsDir() && strings.HasSuffix(de.Name(), config.Instance().Local.Ext) {
-				if state.FileWalker.Position%1000 == 0 {
-					_ = glg.Logf("current dir: %s, position: %d/%d",
-						filepath.Dir(path), state.FileWalker.Position, state.FileWalker.LibSize)
-				}
-				state.FileWalker.Position++
-				if fillCache {
-					libCache := &cache.Instance().Library
-					libCache.Data = append(libCache.Data, path)
+				if progress.Position%1000 == 0 {
+					_ = glg.Logf("current dir: %s, position: %d", filepath.Dir(path), progress.Position)
 				}
+				progress.Position++
+				paths = append(paths, path)
 			}
 			return nil
 		},
 		ErrorCallback: func(path string, err error) godirwalk.ErrorAction {
+			if ctx.Err() != nil {
+				return godirwalk.Halt
+			}
 			if err != nil && err.Error() != "directory ignored" {
 				_ = glg.Warnf("could not read %s, skipping: %s", path, err)
 			}
@@ -602,7 +1091,7 @@ func traverseDir(file *media.File, path string, fillCache bool) ([]media.File, e
 	})
 	if err != nil {
 		_ = glg.Errorf("error traversing directory %s: %s", path, err)
-		return nil, err
+		return nil, nil, err
 	}
-	return matches, nil
+	return matches, paths, nil
 }
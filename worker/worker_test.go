@@ -1,8 +1,15 @@
 package worker
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/Spiritreader/avior-go/comparator"
+	"github.com/Spiritreader/avior-go/config"
+	"github.com/Spiritreader/avior-go/globalstate"
 	"github.com/Spiritreader/avior-go/media"
 )
 
@@ -11,5 +18,56 @@ func TestTraverse(t *testing.T) {
 		Path: "\\\\UMS\\media\\transcoded\\2075 - Verbrannte Erde.mkv",
 		Name: "2075 - Verbrannte Erde",
 	}
-	traverseDir(&file, "\\\\UMS\\media\\transcoded", false)
+	traverseDir(context.Background(), media.NewMatcher(file, ".mkv", config.Instance().Local.DuplicateMatching),
+		"\\\\UMS\\media\\transcoded", &globalstate.PathProgress{})
+}
+
+func TestBestDuplicate(t *testing.T) {
+	candidates := []duplicateVerdict{
+		{File: media.File{Path: "a"}, Result: comparator.REPL},
+		{File: media.File{Path: "b", Resolution: media.Resolution{Value: "1280x720"}}, Result: comparator.NOCH},
+		{File: media.File{Path: "c", Resolution: media.Resolution{Value: "1920x1080"}}, Result: comparator.NOCH},
+	}
+	if best := bestDuplicate(candidates); candidates[best].Path != "c" {
+		t.Errorf("expected c, got %s", candidates[best].Path)
+	}
+	candidates[0].Result = comparator.DISC
+	if best := bestDuplicate(candidates); candidates[best].Path != "a" {
+		t.Errorf("expected a, got %s", candidates[best].Path)
+	}
+}
+
+func TestWalkMediaPaths(t *testing.T) {
+	roots := []string{t.TempDir(), t.TempDir()}
+	for _, path := range []string{
+		filepath.Join(roots[0], "Tatort - Schöne neue Welt.mkv"),
+		filepath.Join(roots[1], "tv", "Tatort - Schöne neue Welt.mkv"),
+		filepath.Join(roots[1], "tv", "Der Pate.mkv"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	matcher := media.NewMatcher(media.File{Name: "Tatort", Subtitle: "Schöne neue Welt"}, ".mkv", config.DuplicateMatching{})
+
+	matches, paths, skipped, err := walkMediaPaths(matcher, roots, config.LibraryWalk{Concurrency: 2})
+	if err != nil || len(skipped) > 0 {
+		t.Fatalf("expected a complete walk, skipped %v: %v", skipped, err)
+	}
+	if len(matches) != 2 || len(paths) != 3 {
+		t.Errorf("expected 2 matches in 3 files, got %d in %d", len(matches), len(paths))
+	}
+	for _, progress := range state.FileWalker.Paths {
+		if !progress.Done || progress.Active {
+			t.Errorf("expected %s to be done", progress.Path)
+		}
+	}
+
+	_, _, skipped, err = walkMediaPaths(matcher, roots, config.LibraryWalk{Concurrency: 1, Timeout: time.Nanosecond})
+	if err != nil || len(skipped) != len(roots) {
+		t.Errorf("expected timed out paths to be skipped, got %v: %v", skipped, err)
+	}
 }